@@ -2,4 +2,9 @@ module bucket
 
 go 1.22.4
 
-require github.com/gorilla/mux v1.8.1 // indirect
+require (
+	github.com/gorilla/mux v1.8.1
+	github.com/lassenordahl/disaggui/obs v0.0.0
+)
+
+replace github.com/lassenordahl/disaggui/obs => ../obs
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -8,22 +11,25 @@ import (
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/lassenordahl/disaggui/obs/config"
 )
 
+// bundlesDir is the directory bundles are served from.
+var bundlesDir = "bundles"
+
 // ListFiles lists all the versions in the bundles directory
 func listFiles() []string {
-	files, err := os.ReadDir("bundles")
+	files, err := os.ReadDir(bundlesDir)
 	if err != nil {
 		log.Fatalf("Failed to list files: %v", err)
 	}
 
 	var versions []string
 	for _, file := range files {
-		// Remove the `.zip` suffix from the filename.
-		version := strings.TrimSuffix(file.Name(), ".zip")
-
-		// Don't add `.DS_Store` to the list of versions.
-		if version == ".DS_Store" {
+		// Only zips are bundles; skip signatures, metadata and files like
+		// `.DS_Store`.
+		version, ok := strings.CutSuffix(file.Name(), ".zip")
+		if !ok {
 			continue
 		}
 
@@ -40,27 +46,110 @@ func handleVersionsList(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// HandleBundle serves serves the `{version}.zip` bundle from the `bundles` directory.
+// HandleBundle serves serves the `{version}.zip` bundle from the bundles directory.
 // Users can download the full bundled zip from this file.
 func handleBundle(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	version := vars["version"]
-	file := fmt.Sprintf("bundles/%s.zip", version)
+	http.ServeFile(w, r, bundlePath(version))
+}
+
+// HandleManifest serves the SHA-256 digest of the `{version}.zip` bundle in the
+// same format as `sha256sum`, so that downloads can be checked for corruption
+// or truncation before they are extracted.
+func handleManifest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	version := vars["version"]
+	md, err := loadMetadata(version)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read metadata for %s: %v", version, err)
+		http.Error(w, "Failed to read bundle metadata", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%s  %s.zip\n", md.SHA256, version)
+}
+
+// HandleBundlesManifest serves the metadata of every bundle as JSON.
+func handleBundlesManifest(w http.ResponseWriter, r *http.Request) {
+	manifest := Manifest{Bundles: []BundleMetadata{}}
+	for _, version := range listFiles() {
+		md, err := loadMetadata(version)
+		if errors.Is(err, errMetadataMismatch) {
+			// Leave the bundle out rather than fail the whole manifest,
+			// so that obs never installs it.
+			log.Printf("Not listing bundle %s: %v", version, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to read metadata for %s: %v", version, err)
+			http.Error(w, "Failed to read bundle metadata", http.StatusInternalServerError)
+			return
+		}
+		manifest.Bundles = append(manifest.Bundles, md)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// HandleSignature serves the detached ed25519 signature of the `{version}.zip`
+// bundle from `bundles/{version}.zip.sig`. Bundles are signed offline with
+// `make sign-bundle`, so the bucket never holds the private key.
+func handleSignature(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	version := vars["version"]
+	file := bundlePath(version) + ".sig"
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
 
+	w.Header().Set("Content-Type", "application/octet-stream")
 	http.ServeFile(w, r, file)
 }
 
 func main() {
+	addr := flag.String("addr", ":8081", "address to serve bundles on")
+	flag.StringVar(&bundlesDir, "bundles-dir", bundlesDir, "directory holding the bundle zips and their metadata")
+	// Uploads and deletes are only allowed with this token, and disabled if
+	// it is not set. Prefer the environment variable, since flags are
+	// visible to other users of the host.
+	uploadToken := flag.String("upload-token", "", "bearer token required to upload and delete bundles; if empty, uploads are disabled")
+	if err := config.Parse(flag.CommandLine, "BUCKET", os.Args[1:]); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if err := config.ValidateAddr("addr", *addr); err != nil {
+		log.Fatal(err)
+	}
+	if info, err := os.Stat(bundlesDir); err != nil || !info.IsDir() {
+		log.Fatalf("-bundles-dir %s is not a directory", bundlesDir)
+	}
+	if *uploadToken == "" {
+		log.Println("No upload token is set, uploads are disabled")
+	}
+
 	// Create a new router
 	r := mux.NewRouter()
 
 	// Define the routes
 	r.HandleFunc("/versions", handleVersionsList).Methods("GET")
+	r.HandleFunc("/manifest", handleBundlesManifest).Methods("GET")
 	r.HandleFunc("/versions/{version}", handleBundle).Methods("GET")
+	r.HandleFunc("/versions/{version}/manifest", handleManifest).Methods("GET")
+	r.HandleFunc("/versions/{version}/signature", handleSignature).Methods("GET")
+	r.HandleFunc("/versions/{version}", requireToken(*uploadToken, handleUpload)).Methods("PUT")
+	r.HandleFunc("/versions/{version}", requireToken(*uploadToken, handleDelete)).Methods("DELETE")
+	r.HandleFunc("/versions/{version}/signature", requireToken(*uploadToken, handleUploadSignature)).Methods("PUT")
 
 	// Start the server
-	log.Println("Serving at http://localhost:8081")
-	if err := http.ListenAndServe(":8081", r); err != nil {
+	log.Printf("Serving %s at %s", bundlesDir, *addr)
+	if err := http.ListenAndServe(*addr, r); err != nil {
 		log.Fatal(err)
 	}
 }
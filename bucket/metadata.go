@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultChannel is the release channel of bundles that do not declare one.
+const defaultChannel = "stable"
+
+// BundleMetadata describes a bundle zip. It is stored in a `{version}.json`
+// sidecar next to the zip, which is written when the bundle is uploaded. For
+// bundles copied into the bucket without one, or with fields missing from it,
+// the missing fields are derived from the zip each time it is read.
+type BundleMetadata struct {
+	Version    string `json:"version"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+	UploadedAt string `json:"uploaded_at"`
+	// MinObsVersion and MaxObsVersion bound, inclusively, the obs versions
+	// the bundle works with. Either may be empty for no bound.
+	MinObsVersion string `json:"min_obs_version,omitempty"`
+	MaxObsVersion string `json:"max_obs_version,omitempty"`
+	Channel       string `json:"channel"`
+}
+
+// Manifest lists every bundle the bucket serves.
+type Manifest struct {
+	Bundles []BundleMetadata `json:"bundles"`
+}
+
+func bundlePath(version string) string {
+	return filepath.Join(bundlesDir, version+".zip")
+}
+
+func metadataPath(version string) string {
+	return filepath.Join(bundlesDir, version+".json")
+}
+
+// errMetadataMismatch is returned by loadMetadata if a bundle no longer
+// matches its recorded metadata, for example because the zip was replaced
+// outside of an upload.
+var errMetadataMismatch = errors.New("bundle does not match its metadata")
+
+// loadMetadata returns the metadata of the bundle for version, deriving fields
+// missing from its sidecar from the zip. It never writes the sidecar. It
+// returns an error satisfying os.IsNotExist if there is no such bundle.
+func loadMetadata(version string) (BundleMetadata, error) {
+	info, err := os.Stat(bundlePath(version))
+	if err != nil {
+		return BundleMetadata{}, err
+	}
+
+	var md BundleMetadata
+	data, err := os.ReadFile(metadataPath(version))
+	if err == nil {
+		if err := json.Unmarshal(data, &md); err != nil {
+			return BundleMetadata{}, fmt.Errorf("failed to parse %s: %v", metadataPath(version), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return BundleMetadata{}, err
+	}
+
+	md.Version = version
+	if md.SHA256 != "" && md.Size != info.Size() {
+		return BundleMetadata{}, fmt.Errorf("%w: %s is %d bytes, but %d bytes were recorded", errMetadataMismatch, bundlePath(version), info.Size(), md.Size)
+	}
+	if md.SHA256 == "" {
+		sum, err := fileSHA256(bundlePath(version))
+		if err != nil {
+			return BundleMetadata{}, err
+		}
+		md.SHA256 = sum
+		md.Size = info.Size()
+	}
+	if md.UploadedAt == "" {
+		md.UploadedAt = info.ModTime().UTC().Format(time.RFC3339)
+	}
+	if md.Channel == "" {
+		md.Channel = defaultChannel
+	}
+	return md, nil
+}
+
+// saveMetadata writes the sidecar of a bundle. It is written to a temporary
+// file first and renamed into place, so readers never see a partial sidecar.
+func saveMetadata(md BundleMetadata) error {
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The temporary file is named so that listFiles skips it.
+	tempFile, err := os.CreateTemp(bundlesDir, "."+md.Version+"-*.json.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(append(data, '\n'))
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tempFile.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), metadataPath(md.Version))
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
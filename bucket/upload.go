@@ -0,0 +1,282 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lassenordahl/disaggui/obs/semver"
+)
+
+// maxBundleSize is the largest bundle zip that can be uploaded.
+const maxBundleSize = 100 << 20
+
+// versionPattern matches the bundle versions that can be uploaded, such as
+// v1.0.3 or v1.1.0-beta.1. Anything else could escape the bundles directory or
+// never be picked by obs.
+var versionPattern = regexp.MustCompile(`^v\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// channelPattern matches the release channels bundles can be uploaded to.
+var channelPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// uploadMu serializes adding and deleting bundles, so that concurrent
+// requests for the same version cannot overwrite each other or leave a zip
+// and its metadata out of sync.
+var uploadMu sync.Mutex
+
+// requireToken rejects requests that do not carry token as a bearer token.
+// If token is empty, every request is rejected, so a bucket server started
+// without one stays read-only.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "Uploads are disabled on this server", http.StatusForbidden)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// HandleUpload stores the request body as the `{version}.zip` bundle and
+// writes its metadata sidecar. The channel and compatible obs versions are
+// taken from the `channel`, `min_obs_version` and `max_obs_version` query
+// parameters, and if `sha256` is given the upload must match it. Versions are
+// never overwritten; delete a version first to replace it.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	version := vars["version"]
+	if !versionPattern.MatchString(version) {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	params := r.URL.Query()
+	md := BundleMetadata{
+		Version:       version,
+		MinObsVersion: params.Get("min_obs_version"),
+		MaxObsVersion: params.Get("max_obs_version"),
+		Channel:       params.Get("channel"),
+	}
+	if md.Channel == "" {
+		md.Channel = defaultChannel
+	}
+	if !channelPattern.MatchString(md.Channel) {
+		http.Error(w, "Invalid channel", http.StatusBadRequest)
+		return
+	}
+	if err := validateObsVersions(md.MinObsVersion, md.MaxObsVersion); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid obs versions: %v", err), http.StatusBadRequest)
+		return
+	}
+	// Checked again before the bundle is added, but checking now saves
+	// reading the upload.
+	if _, err := os.Stat(bundlePath(version)); err == nil {
+		http.Error(w, "Version already exists", http.StatusConflict)
+		return
+	}
+
+	// Write to a temporary file first so a failed upload never shows up in
+	// the listing. It is named so that listFiles skips it.
+	tempFile, err := os.CreateTemp(bundlesDir, ".upload-"+version+"-*.tmp")
+	if err != nil {
+		http.Error(w, "Failed to store bundle", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tempFile, h), http.MaxBytesReader(w, r.Body, maxBundleSize))
+	if err != nil {
+		http.Error(w, "Failed to read bundle", http.StatusBadRequest)
+		return
+	}
+	if err := tempFile.Close(); err != nil {
+		http.Error(w, "Failed to store bundle", http.StatusInternalServerError)
+		return
+	}
+	// CreateTemp makes the file private; bundles are served to anyone.
+	if err := os.Chmod(tempFile.Name(), 0o644); err != nil {
+		http.Error(w, "Failed to store bundle", http.StatusInternalServerError)
+		return
+	}
+	md.Size = size
+	md.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
+	if want := params.Get("sha256"); want != "" && !strings.EqualFold(want, md.SHA256) {
+		http.Error(w, "Checksum mismatch: got "+md.SHA256, http.StatusBadRequest)
+		return
+	}
+
+	if err := validateZip(tempFile.Name(), version); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid bundle: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	uploadMu.Lock()
+	defer uploadMu.Unlock()
+	if _, err := os.Stat(bundlePath(version)); err == nil {
+		http.Error(w, "Version already exists", http.StatusConflict)
+		return
+	}
+	// The metadata is written before the zip is moved in, so the bundle is
+	// listed with the channel it was uploaded to from the start.
+	md.UploadedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := saveMetadata(md); err != nil {
+		http.Error(w, "Failed to store bundle metadata", http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(tempFile.Name(), bundlePath(version)); err != nil {
+		os.Remove(metadataPath(version))
+		http.Error(w, "Failed to store bundle", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Uploaded bundle %s (%d bytes, channel %s)", version, md.Size, md.Channel)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(md)
+}
+
+// validateObsVersions checks the range of obs versions a bundle is uploaded
+// for. Either bound may be left empty, but obs ignores a bound it cannot
+// parse, so a malformed one would make the bundle match every obs version.
+func validateObsVersions(minVersion, maxVersion string) error {
+	var minParsed, maxParsed semver.Version
+	var err error
+	if minVersion != "" {
+		if minParsed, err = semver.Parse(minVersion); err != nil {
+			return fmt.Errorf("invalid min_obs_version: %v", err)
+		}
+	}
+	if maxVersion != "" {
+		if maxParsed, err = semver.Parse(maxVersion); err != nil {
+			return fmt.Errorf("invalid max_obs_version: %v", err)
+		}
+	}
+	if minVersion != "" && maxVersion != "" && maxParsed.LessThan(minParsed) {
+		return fmt.Errorf("min_obs_version %s is greater than max_obs_version %s", minVersion, maxVersion)
+	}
+	return nil
+}
+
+// validateZip checks that the zip at file holds a single `{version}`
+// directory with an index.html in it, which is the layout obs installs.
+func validateZip(file, version string) error {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	hasIndex := false
+	for _, f := range r.File {
+		name := path.Clean(f.Name)
+		if name != version && !strings.HasPrefix(name, version+"/") {
+			return fmt.Errorf("%s is outside the %s directory", f.Name, version)
+		}
+		if name == version+"/index.html" {
+			hasIndex = true
+		}
+	}
+	if !hasIndex {
+		return fmt.Errorf("missing %s/index.html", version)
+	}
+	return nil
+}
+
+// HandleUploadSignature stores the request body as the detached signature of
+// the `{version}.zip` bundle. Like bundles, signatures are never overwritten.
+func handleUploadSignature(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	version := vars["version"]
+	if !versionPattern.MatchString(version) {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	sig, err := io.ReadAll(http.MaxBytesReader(w, r.Body, ed25519.SignatureSize))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		http.Error(w, fmt.Sprintf("Signature must be %d bytes", ed25519.SignatureSize), http.StatusBadRequest)
+		return
+	}
+
+	// Held so the bundle cannot be deleted between checking for it and
+	// storing its signature.
+	uploadMu.Lock()
+	defer uploadMu.Unlock()
+	if _, err := os.Stat(bundlePath(version)); os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.OpenFile(bundlePath(version)+".sig", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if os.IsExist(err) {
+		http.Error(w, "Signature already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to store signature", http.StatusInternalServerError)
+		return
+	}
+	_, err = f.Write(sig)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		http.Error(w, "Failed to store signature", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HandleDelete removes the `{version}.zip` bundle along with its metadata and
+// signature.
+func handleDelete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	version := vars["version"]
+	if !versionPattern.MatchString(version) {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	uploadMu.Lock()
+	defer uploadMu.Unlock()
+	// Remove the zip first so the version disappears from the listing even
+	// if removing the rest fails.
+	err := os.Remove(bundlePath(version))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete bundle", http.StatusInternalServerError)
+		return
+	}
+	for _, file := range []string{metadataPath(version), bundlePath(version) + ".sig"} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s: %v", file, err)
+		}
+	}
+	log.Printf("Deleted bundle %s", version)
+	w.WriteHeader(http.StatusNoContent)
+}
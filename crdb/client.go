@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	obspb "github.com/lassenordahl/disaggui/obs/proto"
+)
+
+// obsClient delivers batches of fingerprints to obs without ever failing the
+// caller. Each call has a deadline and transient failures are retried with
+// backoff. Batches that still cannot be delivered are spooled to disk and
+// replayed, oldest first, once obs is reachable again, so an obs outage loses
+// no fingerprints as long as the spool has room.
+//
+// Delivery is at least once: a batch whose acknowledgement is lost is sent
+// again.
+type obsClient struct {
+	client obspb.CRDBServiceClient
+	// unary sends each fingerprint with ProcessFingerprint instead of
+	// streaming the batch.
+	unary bool
+	retry retryPolicy
+	// spool is nil if spooling is disabled, in which case batches that
+	// cannot be delivered are dropped.
+	spool *spool
+
+	// mu serializes deliveries and guards spool, so batches reach obs in the
+	// order they were delivered.
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+
+	// replayed, replayDropped and evicted count the fingerprints in spooled
+	// batches that were later delivered, dropped while being replayed and
+	// discarded to make room in a full spool.
+	replayed      atomic.Int64
+	replayDropped atomic.Int64
+	evicted       atomic.Int64
+}
+
+// deliveryOutcome is what became of a batch passed to obsClient.deliver.
+type deliveryOutcome int
+
+const (
+	delivered deliveryOutcome = iota
+	spooled
+	dropped
+)
+
+// newObsClient returns an obsClient that, if spool is not nil, checks every
+// replayInterval whether spooled batches can be replayed.
+func newObsClient(client obspb.CRDBServiceClient, unary bool, retry retryPolicy, spool *spool, replayInterval time.Duration) *obsClient {
+	c := &obsClient{
+		client: client,
+		unary:  unary,
+		retry:  retry,
+		spool:  spool,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if spool == nil {
+		close(c.done)
+		return c
+	}
+	if n := spool.len(); n > 0 {
+		log.Printf("Found %d spooled batches to replay", n)
+	}
+	go c.run(replayInterval)
+	return c
+}
+
+func (c *obsClient) run(replayInterval time.Duration) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		c.replay()
+		c.mu.Unlock()
+	}
+}
+
+// Close stops replaying spooled batches. They stay on disk for the next run.
+func (c *obsClient) Close() {
+	close(c.stop)
+	<-c.done
+	if c.spool != nil {
+		if err := c.spool.close(); err != nil {
+			log.Printf("Failed to close spool: %v", err)
+		}
+	}
+}
+
+// deliver sends batch to obs, or spools it if obs is unavailable, and
+// reports which of the two happened. A spooled batch may still be delivered,
+// dropped or evicted from the spool later.
+func (c *obsClient) deliver(batch []*obspb.Fingerprint) deliveryOutcome {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// While older batches are spooled, new ones queue up behind them.
+	if c.spool != nil && c.spool.len() > 0 {
+		outcome := c.spoolBatch(batch)
+		c.replay()
+		return outcome
+	}
+
+	err := c.sendWithRetry(batch)
+	if err == nil {
+		return delivered
+	}
+	if c.spool == nil || !isTransient(err) {
+		log.Printf("Dropped %d fingerprints: %v", len(batch), err)
+		return dropped
+	}
+	log.Printf("obs is unavailable, spooling %d fingerprints: %v", len(batch), err)
+	return c.spoolBatch(batch)
+}
+
+func (c *obsClient) spoolBatch(batch []*obspb.Fingerprint) deliveryOutcome {
+	evicted, err := c.spool.push(batch)
+	c.evicted.Add(int64(evicted))
+	if err != nil {
+		log.Printf("Dropped %d fingerprints: failed to spool them: %v", len(batch), err)
+		return dropped
+	}
+	return spooled
+}
+
+// replay sends spooled batches, oldest first, until the spool is empty or obs
+// turns out to still be unavailable. Each batch gets a single attempt, so
+// that replaying during an outage does not hold up new deliveries. c.mu must
+// be held.
+func (c *obsClient) replay() {
+	replayed := 0
+	for {
+		batch, discarded := c.spool.peek()
+		c.replayDropped.Add(int64(discarded))
+		if batch == nil {
+			break
+		}
+		err := c.send(batch)
+		if isTransient(err) {
+			break
+		}
+		if err != nil {
+			log.Printf("Dropped %d spooled fingerprints: %v", len(batch), err)
+			c.replayDropped.Add(int64(len(batch)))
+		} else {
+			replayed++
+			c.replayed.Add(int64(len(batch)))
+		}
+		c.spool.pop()
+	}
+	if replayed > 0 {
+		log.Printf("Replayed %d spooled batches, %d left", replayed, c.spool.len())
+	}
+}
+
+// sendWithRetry sends batch, retrying transient failures with backoff.
+func (c *obsClient) sendWithRetry(batch []*obspb.Fingerprint) error {
+	var err error
+	for attempt := 1; attempt <= c.retry.attempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(c.retry.backoff(attempt - 1))
+		}
+		err = c.send(batch)
+		if !isTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// send makes a single attempt at sending batch to obs.
+func (c *obsClient) send(batch []*obspb.Fingerprint) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.retry.timeout)
+	defer cancel()
+
+	if c.unary {
+		for _, fp := range batch {
+			resp, err := c.client.ProcessFingerprint(ctx, fp)
+			if err != nil {
+				return err
+			}
+			log.Printf("Response from server: %s", resp.GetMessage())
+		}
+		return nil
+	}
+
+	stream, err := c.client.StreamFingerprints(ctx)
+	if err != nil {
+		return err
+	}
+	for _, fp := range batch {
+		if err := stream.Send(fp); err != nil {
+			// Send reports io.EOF when the stream fails; the cause
+			// comes from CloseAndRecv.
+			break
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Response from server: %s", resp.GetMessage())
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	obspb "github.com/lassenordahl/disaggui/obs/proto"
+)
+
+// dropReportInterval is the most often the exporter logs that it is dropping
+// fingerprints.
+const dropReportInterval = 10 * time.Second
+
+// exporter ships fingerprints to obs in the background, so that statement
+// processing never waits on obs. Export only adds a fingerprint to a bounded
+// queue. A sender goroutine drains the queue in batches, delivering a batch
+// once it reaches batchSize or flushInterval has passed since the last one.
+// When obs cannot keep up and the queue is full, new fingerprints are
+// dropped and counted rather than slowing statements down.
+type exporter struct {
+	client        *obsClient
+	batchSize     int
+	flushInterval time.Duration
+
+	queue chan *obspb.Fingerprint
+	done  chan struct{}
+
+	queued       atomic.Int64
+	queueDropped atomic.Int64
+	exported     atomic.Int64
+	spooled      atomic.Int64
+	dropped      atomic.Int64
+	batches      atomic.Int64
+}
+
+// ExporterStats reports how many fingerprints the exporter has handled.
+// QueueDropped counts fingerprints that never made it into the queue.
+// Exported counts those obs acknowledged, including ones replayed from the
+// spool, and Spooled those spooled while obs was unavailable. Fingerprints
+// lost after being queued are counted under Dropped if they were rejected by
+// obs or could not be spooled, and under SpoolEvicted if they were discarded
+// to make room in a full spool.
+type ExporterStats struct {
+	QueueDepth    int   `json:"queue_depth"`
+	QueueCapacity int   `json:"queue_capacity"`
+	Queued        int64 `json:"queued"`
+	QueueDropped  int64 `json:"queue_dropped"`
+	Exported      int64 `json:"exported"`
+	Spooled       int64 `json:"spooled"`
+	Dropped       int64 `json:"dropped"`
+	SpoolEvicted  int64 `json:"spool_evicted"`
+	Batches       int64 `json:"batches"`
+}
+
+func newExporter(client *obsClient, queueSize, batchSize int, flushInterval time.Duration) *exporter {
+	e := &exporter{
+		client:        client,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		queue:         make(chan *obspb.Fingerprint, queueSize),
+		done:          make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Export queues fp to be sent to obs, dropping it if the queue is full. It
+// never blocks.
+func (e *exporter) Export(fp *obspb.Fingerprint) {
+	select {
+	case e.queue <- fp:
+		e.queued.Add(1)
+	default:
+		e.queueDropped.Add(1)
+	}
+}
+
+// Close sends the fingerprints still queued and waits for them to be
+// delivered or spooled. Export must not be called after Close.
+func (e *exporter) Close() {
+	close(e.queue)
+	<-e.done
+	e.client.Close()
+}
+
+func (e *exporter) Stats() ExporterStats {
+	return ExporterStats{
+		QueueDepth:    len(e.queue),
+		QueueCapacity: cap(e.queue),
+		Queued:        e.queued.Load(),
+		QueueDropped:  e.queueDropped.Load(),
+		Exported:      e.exported.Load() + e.client.replayed.Load(),
+		Spooled:       e.spooled.Load(),
+		Dropped:       e.dropped.Load() + e.client.replayDropped.Load(),
+		SpoolEvicted:  e.client.evicted.Load(),
+		Batches:       e.batches.Load(),
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+
+	var (
+		lastReport      time.Time
+		reportedDropped int64
+	)
+	// reportDrops logs fingerprints dropped from the queue since the last
+	// report, at most once per dropReportInterval. The client logs the ones
+	// it drops itself.
+	reportDrops := func() {
+		dropped := e.queueDropped.Load()
+		if dropped == reportedDropped || time.Since(lastReport) < dropReportInterval {
+			return
+		}
+		log.Printf("Dropped %d fingerprints because the export queue was full; %d dropped from the queue in total", dropped-reportedDropped, dropped)
+		lastReport, reportedDropped = time.Now(), dropped
+	}
+
+	batch := make([]*obspb.Fingerprint, 0, e.batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			n := int64(len(batch))
+			switch e.client.deliver(batch) {
+			case delivered:
+				e.exported.Add(n)
+			case spooled:
+				e.spooled.Add(n)
+			case dropped:
+				e.dropped.Add(n)
+			}
+			e.batches.Add(1)
+			batch = batch[:0]
+		}
+		reportDrops()
+	}
+	for {
+		select {
+		case fp, ok := <-e.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, fp)
+			if len(batch) >= e.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package fingerprint
+
+import (
+	"hash/fnv"
+	"strings"
+	"unicode"
+)
+
+// Placeholder is the token that replaces every literal in a fingerprint.
+const Placeholder = "_"
+
+// morePlaceholder stands in for the remaining elements of a collapsed list.
+const morePlaceholder = "__more__"
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenQuotedIdent
+	tokenLiteral
+	tokenPunct
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// keywords is the set of SQL keywords that are upper-cased in a fingerprint.
+// Any other bare word is treated as an identifier and lower-cased.
+var keywords = map[string]bool{
+	"ADD": true, "ALL": true, "ALTER": true, "AND": true, "ANY": true,
+	"ARRAY": true, "AS": true, "ASC": true, "BEGIN": true, "BETWEEN": true,
+	"BY": true, "CASCADE": true, "CASE": true, "CAST": true, "COLUMN": true,
+	"COMMIT": true, "CONFLICT": true, "CONSTRAINT": true, "CREATE": true,
+	"CROSS": true, "DATABASE": true, "DEFAULT": true, "DELETE": true,
+	"DESC": true, "DISTINCT": true, "DO": true, "DROP": true, "ELSE": true,
+	"END": true, "EXCEPT": true, "EXISTS": true, "EXPLAIN": true,
+	"FALSE": true, "FETCH": true, "FIRST": true, "FOR": true, "FOREIGN": true,
+	"FROM": true, "FULL": true, "GRANT": true, "GROUP": true, "HAVING": true,
+	"IF": true, "ILIKE": true, "IN": true, "INDEX": true, "INNER": true,
+	"INSERT": true, "INTERSECT": true, "INTO": true, "IS": true, "JOIN": true,
+	"KEY": true, "LEFT": true, "LIKE": true, "LIMIT": true, "NOT": true,
+	"NOTHING": true, "NULL": true, "NULLS": true, "OFFSET": true, "ON": true,
+	"OR": true, "ORDER": true, "OUTER": true, "PRIMARY": true,
+	"REFERENCES": true, "RETURNING": true, "REVOKE": true, "RIGHT": true,
+	"ROLLBACK": true, "ROW": true, "ROWS": true, "SAVEPOINT": true,
+	"SELECT": true, "SET": true, "SHOW": true, "TABLE": true, "THEN": true,
+	"TO": true, "TRANSACTION": true, "TRUE": true, "TRUNCATE": true,
+	"UNION": true, "UNIQUE": true, "UPDATE": true, "UPSERT": true,
+	"USING": true, "VALUES": true, "VIEW": true, "WHEN": true, "WHERE": true,
+	"WITH": true,
+}
+
+// Normalize returns the fingerprint of a SQL statement. Keywords are
+// upper-cased, identifiers are lower-cased, whitespace and comments are
+// collapsed, and every literal (numbers, strings, booleans and placeholders
+// such as $1 or ?) is replaced with Placeholder. Lists made up only of
+// literals, such as the right-hand side of an IN, are collapsed to the same
+// form whatever their length, and so are the rows of a VALUES clause, so that
+// the number of elements or rows does not affect the fingerprint.
+//
+// Statements with the same structure produce the same fingerprint:
+//
+//	select * from t where id = 5            -> SELECT * FROM t WHERE id = _
+//	SELECT * FROM t WHERE id IN (1)         -> SELECT * FROM t WHERE id IN (_, __more__)
+//	SELECT * FROM t WHERE id IN (1, 2)      -> SELECT * FROM t WHERE id IN (_, __more__)
+//	INSERT INTO t VALUES (1, 'a'), (2, 'b') -> INSERT INTO t VALUES (_, __more__)
+//
+// An empty string is returned if the statement contains no tokens.
+func Normalize(sql string) string {
+	tokens := collapseRows(collapseLists(foldSigns(tokenize(sql))))
+	return format(tokens)
+}
+
+// ID returns a stable 64-bit identifier for a fingerprint produced by
+// Normalize. It is the FNV-1a hash of the fingerprint, so every node computes
+// the same ID for the same statement shape across restarts.
+func ID(fingerprint string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(fingerprint))
+	return h.Sum64()
+}
+
+// tokenize splits a statement into tokens, dropping whitespace and comments
+// and replacing literals with Placeholder.
+func tokenize(sql string) []token {
+	var tokens []token
+	src := []rune(sql)
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '-' && peek(src, i+1) == '-':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+
+		case c == '/' && peek(src, i+1) == '*':
+			i += 2
+			for i < len(src) && !(src[i] == '*' && peek(src, i+1) == '/') {
+				i++
+			}
+			i += 2
+
+		case c == '\'':
+			i = skipQuoted(src, i, '\'')
+			tokens = append(tokens, token{kind: tokenLiteral, text: Placeholder})
+
+		case c == '"':
+			end := skipQuoted(src, i, '"')
+			tokens = append(tokens, token{kind: tokenQuotedIdent, text: string(src[i:end])})
+			i = end
+
+		case unicode.IsDigit(c) || (c == '.' && unicode.IsDigit(peek(src, i+1))):
+			i = skipNumber(src, i)
+			tokens = append(tokens, token{kind: tokenLiteral, text: Placeholder})
+
+		case c == '$' && unicode.IsDigit(peek(src, i+1)):
+			i++
+			for i < len(src) && unicode.IsDigit(src[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenLiteral, text: Placeholder})
+
+		case c == '?':
+			i++
+			tokens = append(tokens, token{kind: tokenLiteral, text: Placeholder})
+
+		case isWordStart(c):
+			start := i
+			for i < len(src) && isWordPart(src[i]) {
+				i++
+			}
+			word := string(src[start:i])
+
+			// Typed string literals such as e'..', b'..' and x'..' are
+			// literals in their entirety.
+			if len(word) == 1 && strings.ContainsRune("eEbBxX", c) && peek(src, i) == '\'' {
+				i = skipQuoted(src, i, '\'')
+				tokens = append(tokens, token{kind: tokenLiteral, text: Placeholder})
+				continue
+			}
+
+			upper := strings.ToUpper(word)
+			switch {
+			case upper == "TRUE" || upper == "FALSE":
+				tokens = append(tokens, token{kind: tokenLiteral, text: Placeholder})
+			case keywords[upper]:
+				tokens = append(tokens, token{kind: tokenWord, text: upper})
+			default:
+				tokens = append(tokens, token{kind: tokenWord, text: strings.ToLower(word)})
+			}
+
+		case strings.ContainsRune("(),;.[]", c):
+			i++
+			if c == ';' {
+				continue
+			}
+			tokens = append(tokens, token{kind: tokenPunct, text: string(c)})
+
+		default:
+			// A sign is only absorbed into an operator run as its first
+			// character, so that `x=-5` lexes as `=` followed by `-`.
+			start := i
+			for i < len(src) && isOperator(src[i]) && (i == start || (src[i] != '-' && src[i] != '+')) {
+				i++
+			}
+			if i == start {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: string(src[start:i])})
+		}
+	}
+	return tokens
+}
+
+// foldSigns merges a unary minus or plus into the literal that follows it,
+// so that `x = -5` and `x = 5` share a fingerprint.
+func foldSigns(tokens []token) []token {
+	out := tokens[:0]
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind == tokenOperator && (t.text == "-" || t.text == "+") &&
+			i+1 < len(tokens) && tokens[i+1].kind == tokenLiteral && isUnaryPosition(out) {
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// isUnaryPosition reports whether a sign following the given tokens is a
+// unary operator rather than a binary one.
+func isUnaryPosition(prev []token) bool {
+	if len(prev) == 0 {
+		return true
+	}
+	last := prev[len(prev)-1]
+	switch last.kind {
+	case tokenOperator:
+		return true
+	case tokenPunct:
+		return last.text != ")" && last.text != "]"
+	case tokenWord:
+		return keywords[last.text]
+	default:
+		return false
+	}
+}
+
+// collapseLists rewrites every parenthesized or bracketed list that contains
+// one or more literals and nothing else to `(_, __more__)`.
+func collapseLists(tokens []token) []token {
+	var out []token
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind == tokenPunct && (t.text == "(" || t.text == "[") {
+			if end, ok := literalList(tokens, i); ok {
+				closing := tokens[end]
+				out = append(out,
+					t,
+					token{kind: tokenLiteral, text: Placeholder},
+					token{kind: tokenPunct, text: ","},
+					token{kind: tokenLiteral, text: morePlaceholder},
+					closing,
+				)
+				i = end
+				continue
+			}
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// literalList reports whether the list opened at tokens[open] contains only
+// comma-separated literals, and if so returns the index of its closing token.
+func literalList(tokens []token, open int) (int, bool) {
+	closing := ")"
+	if tokens[open].text == "[" {
+		closing = "]"
+	}
+	count := 0
+	for i := open + 1; i < len(tokens); i++ {
+		t := tokens[i]
+		wantLiteral := (i-open)%2 == 1
+		switch {
+		case wantLiteral && t.kind == tokenLiteral:
+			count++
+		case !wantLiteral && t.kind == tokenPunct && t.text == ",":
+		case !wantLiteral && t.kind == tokenPunct && t.text == closing:
+			return i, count > 0
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// collapseRows drops the rows of a VALUES clause that repeat the row before
+// them, so that single-row and multi-row inserts of the same shape share a
+// fingerprint. It runs after collapseLists, so rows of literals are already
+// identical.
+func collapseRows(tokens []token) []token {
+	var out []token
+	for i := 0; i < len(tokens); i++ {
+		out = append(out, tokens[i])
+		if tokens[i].kind != tokenWord || tokens[i].text != "VALUES" {
+			continue
+		}
+		end, ok := group(tokens, i+1)
+		if !ok {
+			continue
+		}
+		row := tokens[i+1 : end+1]
+		out = append(out, row...)
+		i = end
+		for i+1 < len(tokens) && tokens[i+1].text == "," {
+			next, ok := group(tokens, i+2)
+			if !ok || !equalTokens(tokens[i+2:next+1], row) {
+				break
+			}
+			i = next
+		}
+	}
+	return out
+}
+
+// group reports whether tokens[open] opens a parenthesized group, and if so
+// returns the index of the parenthesis that closes it.
+func group(tokens []token, open int) (int, bool) {
+	if open >= len(tokens) || tokens[open].kind != tokenPunct || tokens[open].text != "(" {
+		return 0, false
+	}
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		if tokens[i].kind != tokenPunct {
+			continue
+		}
+		switch tokens[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func equalTokens(a, b []token) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// format joins tokens with single spaces, omitting the space where SQL is
+// conventionally written without one (around dots, inside parentheses,
+// before commas and between a function name and its arguments).
+func format(tokens []token) string {
+	var b strings.Builder
+	for i, t := range tokens {
+		if i > 0 && needsSpace(tokens[i-1], t) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+func needsSpace(prev, cur token) bool {
+	switch {
+	case prev.text == "." || cur.text == ".":
+		return false
+	case prev.text == "(" || prev.text == "[":
+		return false
+	case cur.text == ")" || cur.text == "]" || cur.text == ",":
+		return false
+	case prev.text == "::" || cur.text == "::":
+		return false
+	case cur.text == "(" || cur.text == "[":
+		// Function calls and array subscripts hug their arguments; keywords
+		// such as IN and VALUES do not.
+		if prev.kind == tokenWord && !keywords[prev.text] {
+			return false
+		}
+		return prev.text != "ARRAY" || cur.text != "["
+	}
+	return true
+}
+
+func peek(src []rune, i int) rune {
+	if i < len(src) {
+		return src[i]
+	}
+	return 0
+}
+
+// skipQuoted returns the index just past the quoted run starting at
+// src[start]. A doubled quote character is treated as an escaped quote.
+func skipQuoted(src []rune, start int, quote rune) int {
+	i := start + 1
+	for i < len(src) {
+		if src[i] == quote {
+			if peek(src, i+1) == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return i
+}
+
+// skipNumber returns the index just past the numeric literal starting at
+// src[start], including hex literals, decimals and exponents.
+func skipNumber(src []rune, start int) int {
+	i := start
+	if src[i] == '0' && (peek(src, i+1) == 'x' || peek(src, i+1) == 'X') {
+		i += 2
+		for i < len(src) && strings.ContainsRune("0123456789abcdefABCDEF", src[i]) {
+			i++
+		}
+		return i
+	}
+	for i < len(src) && (unicode.IsDigit(src[i]) || src[i] == '.') {
+		i++
+	}
+	if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+		j := i + 1
+		if peek(src, j) == '+' || peek(src, j) == '-' {
+			j++
+		}
+		if unicode.IsDigit(peek(src, j)) {
+			i = j
+			for i < len(src) && unicode.IsDigit(src[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+func isWordStart(c rune) bool {
+	return c == '_' || unicode.IsLetter(c)
+}
+
+func isWordPart(c rune) bool {
+	return c == '_' || c == '$' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+func isOperator(c rune) bool {
+	return strings.ContainsRune("+-*/<>=~!@#%^&|`:", c)
+}
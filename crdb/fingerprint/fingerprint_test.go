@@ -0,0 +1,73 @@
+package fingerprint
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{"empty", "", ""},
+		{"only comments", "-- nothing here\n/* or here */", ""},
+		{"mixed case", "select ID, Name from Users where ID = 5", "SELECT id, name FROM users WHERE id = _"},
+		{"whitespace", "SELECT\t*\n  FROM   t", "SELECT * FROM t"},
+		{"trailing semicolon", "SELECT 1;", "SELECT _"},
+		{"quoted identifier", `SELECT "Name" FROM t`, `SELECT "Name" FROM t`},
+		{"string", "SELECT * FROM t WHERE name = 'bob'", "SELECT * FROM t WHERE name = _"},
+		{"escaped quote", "SELECT * FROM t WHERE name = 'o''brien' AND id = 1", "SELECT * FROM t WHERE name = _ AND id = _"},
+		{"quote in comment", "SELECT 1 -- it's fine\nFROM t", "SELECT _ FROM t"},
+		{"line comment", "SELECT * -- columns\nFROM t", "SELECT * FROM t"},
+		{"block comment", "SELECT /* all */ * FROM t", "SELECT * FROM t"},
+		{"typed string", "SELECT * FROM t WHERE b = x'ff' OR s = e'a\\n'", "SELECT * FROM t WHERE b = _ OR s = _"},
+		{"decimal and exponent", "SELECT 1.5, .5, 1e-3, 0xFF", "SELECT _, _, _, _"},
+		{"negative number", "SELECT * FROM t WHERE x = -5", "SELECT * FROM t WHERE x = _"},
+		{"negative without spaces", "SELECT * FROM t WHERE x=-5", "SELECT * FROM t WHERE x = _"},
+		{"binary minus", "SELECT a - 1 FROM t", "SELECT a - _ FROM t"},
+		{"positional placeholder", "SELECT * FROM t WHERE id = $1 AND name = $12", "SELECT * FROM t WHERE id = _ AND name = _"},
+		{"question mark placeholder", "SELECT * FROM t WHERE id = ?", "SELECT * FROM t WHERE id = _"},
+		{"booleans", "UPDATE t SET flag = true WHERE other = FALSE", "UPDATE t SET flag = _ WHERE other = _"},
+		{"null is kept", "SELECT * FROM t WHERE x IS NULL", "SELECT * FROM t WHERE x IS NULL"},
+		{"function call", "SELECT count(*) FROM t", "SELECT count(*) FROM t"},
+		{"qualified name", "SELECT t.id FROM db.t", "SELECT t.id FROM db.t"},
+		{"cast", "SELECT x::INT FROM t", "SELECT x::int FROM t"},
+		{"in single", "SELECT * FROM t WHERE id IN (1)", "SELECT * FROM t WHERE id IN (_, __more__)"},
+		{"in many", "SELECT * FROM t WHERE id IN (1, 2, 3)", "SELECT * FROM t WHERE id IN (_, __more__)"},
+		{"in placeholders", "SELECT * FROM t WHERE id IN ($1, $2)", "SELECT * FROM t WHERE id IN (_, __more__)"},
+		{"in subquery", "SELECT * FROM t WHERE id IN (SELECT id FROM u)", "SELECT * FROM t WHERE id IN (SELECT id FROM u)"},
+		{"array", "SELECT ARRAY[1, 2]", "SELECT ARRAY[_, __more__]"},
+		{"values single row", "INSERT INTO t VALUES (1, 'a')", "INSERT INTO t VALUES (_, __more__)"},
+		{"values many rows", "INSERT INTO t VALUES (1, 'a'), (2, 'b'), (3, 'c')", "INSERT INTO t VALUES (_, __more__)"},
+		{"values with expressions", "INSERT INTO t VALUES (1, now()), (2, now())", "INSERT INTO t VALUES (_, now())"},
+		{"values different rows", "INSERT INTO t VALUES (1, now()), (2, 3)", "INSERT INTO t VALUES (_, now()), (_, __more__)"},
+		{"values returning", "INSERT INTO t VALUES (1), (2) RETURNING id", "INSERT INTO t VALUES (_, __more__) RETURNING id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Normalize(tt.sql); got != tt.want {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.sql, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeSameShape(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"SELECT * FROM t WHERE id IN (1)", "SELECT * FROM t WHERE id IN (1, 2)"},
+		{"select * from t where id in (1,2,3)", "SELECT * FROM T WHERE ID IN ($1)"},
+		{"INSERT INTO t (a, b) VALUES (1, 2)", "INSERT INTO t (a, b) VALUES (1, 2), (3, 4)"},
+		{"SELECT * FROM t WHERE x = -5", "SELECT * FROM t WHERE x = 5"},
+		{"SELECT 'it''s'", "SELECT 'plain'"},
+	}
+	for _, tt := range tests {
+		a, b := Normalize(tt.a), Normalize(tt.b)
+		if a != b {
+			t.Errorf("Normalize(%q) = %q and Normalize(%q) = %q, want them equal", tt.a, a, tt.b, b)
+		}
+		if ID(a) != ID(b) {
+			t.Errorf("ID differs for %q and %q", tt.a, tt.b)
+		}
+	}
+}
@@ -3,66 +3,170 @@ package main
 import (
 	"bufio"
 	"context"
+	"expvar"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
+	crdbpb "github.com/lassenordahl/disaggui/crdb/proto"
+	"github.com/lassenordahl/disaggui/obs/config"
 	obspb "github.com/lassenordahl/disaggui/obs/proto"
+	"github.com/lassenordahl/disaggui/obs/tlsconfig"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
-func handleStatements(client obspb.CRDBServiceClient, reader *bufio.Reader) {
+func handleStatements(exporter *exporter, reader *bufio.Reader) {
 	for {
 		fmt.Print("Enter text: ")
 		input, err := reader.ReadString('\n')
+		received := time.Now()
+		if err == io.EOF {
+			return
+		}
 		if err != nil {
 			log.Fatalf("Failed to read input: %v", err)
 		}
 
-		input = strings.TrimSpace(input)
-		words := strings.Fields(input)
-		var capitalizedWords []string
-		for _, word := range words {
-			if isCapitalized(word) {
-				capitalizedWords = append(capitalizedWords, word)
-			}
+		fp, ok := processStatement(input, received)
+		if !ok {
+			continue
 		}
 
-		if len(capitalizedWords) == 0 {
-			continue
+		exporter.Export(fp)
+	}
+}
+
+func main() {
+	obsAddr := flag.String("obs-addr", "localhost:50051", "address of the obs gRPC ingestion API")
+	var tlsFiles tlsconfig.Files
+	flag.StringVar(&tlsFiles.CA, "tls-ca", "", "PEM CA bundle to verify obs against; setting it or -tls-cert connects to obs with TLS")
+	flag.StringVar(&tlsFiles.Cert, "tls-cert", "", "PEM client certificate to present to obs")
+	flag.StringVar(&tlsFiles.Key, "tls-key", "", "PEM private key for -tls-cert")
+	tlsReloadInterval := flag.Duration("tls-reload-interval", 10*time.Second, "how often to check the TLS files for changes")
+	batchSize := flag.Int("batch-size", 100, "number of fingerprints to send to obs per stream; 1 sends each fingerprint with a unary call")
+	flushInterval := flag.Duration("flush-interval", time.Second, "maximum time a fingerprint is buffered before it is sent to obs")
+	queueSize := flag.Int("queue-size", 10000, "number of fingerprints queued for obs before new ones are dropped")
+	debugAddr := flag.String("debug-addr", "", "address to serve exporter stats on at /debug/vars; empty disables it")
+	listenAddr := flag.String("listen", ":26257", "address to serve the CRDBService gRPC API on; empty disables the server")
+	repl := flag.Bool("repl", true, "read statements from stdin; when false crdb only serves gRPC until interrupted")
+	var retry retryPolicy
+	flag.DurationVar(&retry.timeout, "rpc-timeout", 5*time.Second, "deadline for each call to obs")
+	flag.IntVar(&retry.attempts, "retry-attempts", 5, "number of times a batch is sent while obs is unavailable before it is spooled")
+	flag.DurationVar(&retry.initialBackoff, "retry-backoff", 100*time.Millisecond, "wait before the first retry; it doubles with each retry up to -retry-max-backoff")
+	flag.DurationVar(&retry.maxBackoff, "retry-max-backoff", 5*time.Second, "longest wait between retries")
+	spoolDir := flag.String("spool-dir", "crdb-spool", "directory fingerprints are spooled to while obs is unavailable, which only one crdb process can use at a time; empty disables spooling")
+	spoolMaxBytes := flag.Int64("spool-max-bytes", 64<<20, "maximum size of the spool; the oldest batches are discarded beyond it")
+	replayInterval := flag.Duration("spool-replay-interval", 5*time.Second, "how often to check whether spooled fingerprints can be replayed")
+	if err := config.Parse(flag.CommandLine, "CRDB", os.Args[1:]); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if err := config.ValidateAddr("obs-addr", *obsAddr); err != nil {
+		log.Fatal(err)
+	}
+	if *listenAddr != "" {
+		if err := config.ValidateAddr("listen", *listenAddr); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		// Generate a timestamp for the fingerprint.
-		timestamp := time.Now().Format(time.UTC.String())
-		fingerprint := &obspb.Fingerprint{
-			Input:     strings.Join(capitalizedWords, " "),
-			Timestamp: timestamp,
+	if retry.timeout <= 0 || retry.attempts < 1 || retry.initialBackoff < 0 || retry.maxBackoff < 0 {
+		log.Fatalf("-rpc-timeout and -retry-attempts must be positive, and backoffs must not be negative")
+	}
+	if *queueSize <= 0 || *flushInterval <= 0 {
+		log.Fatalf("-queue-size and -flush-interval must be positive")
+	}
+	if *debugAddr != "" {
+		if err := config.ValidateAddr("debug-addr", *debugAddr); err != nil {
+			log.Fatal(err)
 		}
+	}
+	if *spoolMaxBytes <= 0 || *replayInterval <= 0 {
+		log.Fatalf("-spool-max-bytes and -spool-replay-interval must be positive")
+	}
 
-		resp, err := client.ProcessFingerprint(context.Background(), fingerprint)
+	if *tlsReloadInterval <= 0 {
+		log.Fatalf("-tls-reload-interval must be positive")
+	}
+	transport := grpc.WithInsecure()
+	if tlsFiles != (tlsconfig.Files{}) {
+		reloader, err := tlsconfig.NewReloader(tlsFiles)
 		if err != nil {
-			log.Fatalf("Error calling ProcessFingerprint: %v", err)
+			log.Fatalf("Failed to configure TLS: %v", err)
 		}
-
-		log.Printf("Response from server: %s", resp.GetMessage())
+		go reloader.Watch(context.Background(), *tlsReloadInterval)
+		transport = grpc.WithTransportCredentials(credentials.NewTLS(reloader.ClientConfig()))
 	}
-}
-
-func isCapitalized(s string) bool {
-	return strings.ToUpper(s) == s
-}
 
-func main() {
-	conn, err := grpc.Dial("localhost:50051", grpc.WithInsecure())
+	conn, err := grpc.Dial(*obsAddr, transport)
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
 	defer conn.Close()
 
 	client := obspb.NewCRDBServiceClient(conn)
-	reader := bufio.NewReader(os.Stdin)
 
-	handleStatements(client, reader)
+	var diskSpool *spool
+	if *spoolDir != "" {
+		diskSpool, err = openSpool(*spoolDir, *spoolMaxBytes)
+		if err != nil {
+			log.Fatalf("Failed to open spool: %v", err)
+		}
+	}
+
+	if *batchSize < 1 {
+		*batchSize = 1
+	}
+	obs := newObsClient(client, *batchSize == 1, retry, diskSpool, *replayInterval)
+	exporter := newExporter(obs, *queueSize, *batchSize, *flushInterval)
+	defer exporter.Close()
+
+	if *debugAddr != "" {
+		expvar.Publish("exporter", expvar.Func(func() any { return exporter.Stats() }))
+		go func() {
+			log.Printf("Debug server is running on %s", *debugAddr)
+			// The debug server is optional, so failing to start it is
+			// not fatal.
+			if err := http.ListenAndServe(*debugAddr, nil); err != nil {
+				log.Printf("Debug server stopped: %v", err)
+			}
+		}()
+	}
+
+	if *listenAddr != "" {
+		lis, err := net.Listen("tcp", *listenAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen: %v", err)
+		}
+
+		s := grpc.NewServer()
+		crdbpb.RegisterCRDBServiceServer(s, &server{exporter: exporter})
+		defer s.GracefulStop()
+
+		go func() {
+			log.Printf("gRPC server is running on %s", lis.Addr())
+			// Serve returns ErrServerStopped if the REPL finishes and stops
+			// the server before this goroutine is scheduled.
+			if err := s.Serve(lis); err != nil && err != grpc.ErrServerStopped {
+				log.Fatalf("Failed to serve: %v", err)
+			}
+		}()
+	}
+
+	if *repl {
+		reader := bufio.NewReader(os.Stdin)
+		handleStatements(exporter, reader)
+		return
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retryPolicy controls how calls to obs are retried.
+type retryPolicy struct {
+	// timeout bounds each attempt.
+	timeout time.Duration
+	// attempts is the number of tries a batch gets before it is spooled.
+	attempts       int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// backoff returns how long to wait before the nth retry. The wait doubles
+// with each retry up to maxBackoff, and is jittered so that clients cut off
+// by the same obs restart do not all retry at once.
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := p.maxBackoff
+	if n < 32 && p.initialBackoff<<(n-1) < p.maxBackoff {
+		d = p.initialBackoff << (n - 1)
+	}
+	if d <= 0 {
+		return 0
+	}
+	// Wait between half and all of d.
+	return d/2 + rand.N(d/2+1)
+}
+
+// isTransient reports whether err is a failure that may go away if the call
+// is retried, such as obs restarting.
+func isTransient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lassenordahl/disaggui/crdb/fingerprint"
+	crdbpb "github.com/lassenordahl/disaggui/crdb/proto"
+	obspb "github.com/lassenordahl/disaggui/obs/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// server accepts statements over gRPC and forwards their fingerprints to obs,
+// the same way the stdin REPL does.
+type server struct {
+	crdbpb.UnimplementedCRDBServiceServer
+	exporter *exporter
+}
+
+func (s *server) ProcessStatement(ctx context.Context, req *crdbpb.Statement) (*crdbpb.Ack, error) {
+	fp, ok := processStatement(req.GetInput(), time.Now())
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "statement is empty")
+	}
+
+	s.exporter.Export(fp)
+	return &crdbpb.Ack{Message: fmt.Sprintf("Statement processed as fingerprint %016x", fp.GetFingerprintId())}, nil
+}
+
+// processStatement fingerprints a statement received at the given time and
+// builds the message reported to obs. It returns false if the statement
+// contains no tokens.
+//
+// This simulated database does not execute statements, so the latency
+// reported to obs is the time spent processing the statement since it was
+// received, not an execution time.
+func processStatement(input string, received time.Time) (*obspb.Fingerprint, bool) {
+	normalized := fingerprint.Normalize(input)
+	if normalized == "" {
+		return nil, false
+	}
+	processing := time.Since(received)
+
+	return &obspb.Fingerprint{
+		Input:         normalized,
+		Timestamp:     received.UTC().Format(time.RFC3339Nano),
+		FingerprintId: fingerprint.ID(normalized),
+		LatencyNanos:  processing.Nanoseconds(),
+	}, true
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	obspb "github.com/lassenordahl/disaggui/obs/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// spoolSuffix is the extension of the files batches are spooled to.
+const spoolSuffix = ".spool"
+
+// spoolLockName is the file in the spool directory that the crdb process
+// using it holds a lock on.
+const spoolLockName = ".lock"
+
+// spool is a bounded FIFO of fingerprint batches on disk, holding what could
+// not be delivered while obs was unavailable. Each batch is a file named by a
+// sequence number, so the directory lists them oldest first and survives
+// crdb restarts. When the spool is full the oldest batches are discarded to
+// make room, keeping the most recent fingerprints.
+//
+// Only one process can use a spool directory at a time, since each keeps
+// its own sequence numbers. A spool is not safe for concurrent use.
+type spool struct {
+	dir      string
+	maxBytes int64
+	lock     *os.File
+
+	segments []spoolSegment
+	size     int64
+	nextSeq  uint64
+}
+
+type spoolSegment struct {
+	name string
+	size int64
+	// count is the number of fingerprints in the batch.
+	count int
+}
+
+// openSpool opens the spool in dir, creating dir if needed and picking up
+// batches spooled by an earlier run. It fails if another process has the
+// spool open.
+func openSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	lock, err := lockSpool(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	s := &spool{dir: dir, maxBytes: maxBytes, lock: lock}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Left behind by a crash while spooling.
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+		// An unreadable batch is counted as empty here, and discarded
+		// by peek when its turn comes.
+		batch, _ := s.read(name)
+		s.segments = append(s.segments, spoolSegment{name: name, size: info.Size(), count: len(batch)})
+		s.size += info.Size()
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	// Names are zero-padded, so they sort in sequence order.
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].name < s.segments[j].name })
+	return s, nil
+}
+
+// lockSpool takes an exclusive lock on dir's lock file. The lock is released
+// when the file is closed, including when the process exits.
+func lockSpool(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, spoolLockName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s is in use by another crdb process; give each one its own -spool-dir", dir)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", dir, err)
+	}
+	return f, nil
+}
+
+// close releases the spool, leaving its batches on disk for the next run.
+func (s *spool) close() error {
+	return s.lock.Close()
+}
+
+// len returns the number of spooled batches.
+func (s *spool) len() int {
+	return len(s.segments)
+}
+
+// push appends batch to the spool, discarding the oldest batches if it does
+// not fit, and returns the number of fingerprints discarded.
+func (s *spool) push(batch []*obspb.Fingerprint) (evicted int, err error) {
+	var data []byte
+	for _, fp := range batch {
+		b, err := proto.Marshal(fp)
+		if err != nil {
+			return 0, err
+		}
+		data = binary.AppendUvarint(data, uint64(len(b)))
+		data = append(data, b...)
+	}
+	if int64(len(data)) > s.maxBytes {
+		return 0, fmt.Errorf("batch of %d bytes is larger than the spool", len(data))
+	}
+
+	for len(s.segments) > 0 && s.size+int64(len(data)) > s.maxBytes {
+		log.Printf("Spool is full, discarding the oldest spooled batch %s", s.segments[0].name)
+		evicted += s.segments[0].count
+		s.pop()
+	}
+
+	seg := spoolSegment{name: fmt.Sprintf("%020d%s", s.nextSeq, spoolSuffix), size: int64(len(data)), count: len(batch)}
+	path := filepath.Join(s.dir, seg.name)
+	// Write to a temporary file first, so a crash never leaves a truncated
+	// batch behind.
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return evicted, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return evicted, err
+	}
+	s.nextSeq++
+	s.segments = append(s.segments, seg)
+	s.size += seg.size
+	return evicted, nil
+}
+
+// peek returns the oldest spooled batch, or nil if the spool is empty.
+// Batches that cannot be read are discarded, and the number of fingerprints
+// they held is returned.
+func (s *spool) peek() (batch []*obspb.Fingerprint, discarded int) {
+	for len(s.segments) > 0 {
+		batch, err := s.read(s.segments[0].name)
+		if err == nil {
+			return batch, discarded
+		}
+		log.Printf("Discarding unreadable spooled batch %s: %v", s.segments[0].name, err)
+		discarded += s.segments[0].count
+		s.pop()
+	}
+	return nil, discarded
+}
+
+// pop removes the oldest spooled batch.
+func (s *spool) pop() {
+	seg := s.segments[0]
+	if err := os.Remove(filepath.Join(s.dir, seg.name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove spooled batch %s: %v", seg.name, err)
+	}
+	s.segments = s.segments[1:]
+	s.size -= seg.size
+}
+
+func (s *spool) read(name string) ([]*obspb.Fingerprint, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	var batch []*obspb.Fingerprint
+	for len(data) > 0 {
+		n, read := binary.Uvarint(data)
+		if read <= 0 || uint64(len(data)-read) < n {
+			return nil, fmt.Errorf("truncated fingerprint")
+		}
+		data = data[read:]
+		fp := &obspb.Fingerprint{}
+		if err := proto.Unmarshal(data[:n], fp); err != nil {
+			return nil, err
+		}
+		batch = append(batch, fp)
+		data = data[n:]
+	}
+	return batch, nil
+}
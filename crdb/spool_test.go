@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	obspb "github.com/lassenordahl/disaggui/obs/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func spoolBatch(n int) []*obspb.Fingerprint {
+	batch := make([]*obspb.Fingerprint, n)
+	for i := range batch {
+		batch[i] = &obspb.Fingerprint{Input: fmt.Sprintf("SELECT %d", i), FingerprintId: uint64(i)}
+	}
+	return batch
+}
+
+// batchSize returns the number of bytes batch takes up in the spool.
+func batchSize(batch []*obspb.Fingerprint) int64 {
+	var size int64
+	for _, fp := range batch {
+		size += int64(proto.Size(fp)) + 1
+	}
+	return size
+}
+
+func TestSpoolEvictionCounts(t *testing.T) {
+	dir := t.TempDir()
+	// Room for two batches of three.
+	s, err := openSpool(dir, 2*batchSize(spoolBatch(3)))
+	if err != nil {
+		t.Fatalf("failed to open spool: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if evicted, err := s.push(spoolBatch(3)); err != nil || evicted != 0 {
+			t.Fatalf("push %d evicted %d, %v, want nothing", i, evicted, err)
+		}
+	}
+
+	// Counts of batches spooled by an earlier run are read back from disk.
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = openSpool(dir, s.maxBytes)
+	if err != nil {
+		t.Fatalf("failed to reopen spool: %v", err)
+	}
+	if evicted, err := s.push(spoolBatch(3)); err != nil || evicted != 3 {
+		t.Errorf("push into a full spool evicted %d, %v, want 3", evicted, err)
+	}
+	if evicted, err := s.push(spoolBatch(1)); err != nil || evicted != 3 {
+		t.Errorf("push into a full spool evicted %d, %v, want 3", evicted, err)
+	}
+	if s.len() != 2 {
+		t.Errorf("spool holds %d batches, want 2", s.len())
+	}
+	s.close()
+}
+
+func TestSpoolLock(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to open spool: %v", err)
+	}
+	if _, err := openSpool(dir, 1<<20); err == nil {
+		t.Fatal("opened a spool that is already open")
+	}
+
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to reopen spool after closing it: %v", err)
+	}
+	s.close()
+}
+
+func TestSpoolPushTooLarge(t *testing.T) {
+	s, err := openSpool(t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("failed to open spool: %v", err)
+	}
+	defer s.close()
+	if evicted, err := s.push(spoolBatch(1)); err == nil || evicted != 0 {
+		t.Errorf("push of an oversized batch returned %d, %v, want an error", evicted, err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// broker fans out newly stored fingerprints to live subscribers. Publishing
+// never blocks: each subscriber has its own buffer, and events that do not
+// fit are dropped and counted rather than slowing down ingestion.
+type broker struct {
+	bufferSize int
+
+	mu          sync.RWMutex
+	subscribers map[int64]*subscriber
+	nextID      int64
+
+	published atomic.Int64
+	delivered atomic.Int64
+	dropped   atomic.Int64
+}
+
+// subscriber is a single live feed. Events matching filter are delivered on
+// events until the subscriber is removed with broker.unsubscribe.
+type subscriber struct {
+	broker     *broker
+	id         int64
+	remoteAddr string
+	connected  time.Time
+	filter     func(fingerprintEvent) bool
+	events     chan fingerprintEvent
+
+	delivered atomic.Int64
+	dropped   atomic.Int64
+	// unreported counts drops the subscriber has not yet been told about.
+	unreported atomic.Int64
+}
+
+// BrokerStats reports the state of the live fingerprint feed. The totals
+// include subscribers that have since disconnected.
+type BrokerStats struct {
+	Published   int64             `json:"published"`
+	Delivered   int64             `json:"delivered"`
+	Dropped     int64             `json:"dropped"`
+	Subscribers []SubscriberStats `json:"subscribers"`
+}
+
+type SubscriberStats struct {
+	ID         int64  `json:"id"`
+	RemoteAddr string `json:"remote_addr"`
+	Connected  string `json:"connected"`
+	Buffered   int    `json:"buffered"`
+	Delivered  int64  `json:"delivered"`
+	Dropped    int64  `json:"dropped"`
+}
+
+func newBroker(bufferSize int) *broker {
+	return &broker{
+		bufferSize:  bufferSize,
+		subscribers: make(map[int64]*subscriber),
+	}
+}
+
+// subscribe registers a subscriber for the events accepted by filter, or for
+// every event if filter is nil.
+func (b *broker) subscribe(remoteAddr string, filter func(fingerprintEvent) bool) *subscriber {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	sub := &subscriber{
+		broker:     b,
+		id:         b.nextID,
+		remoteAddr: remoteAddr,
+		connected:  time.Now(),
+		filter:     filter,
+		events:     make(chan fingerprintEvent, b.bufferSize),
+	}
+	b.subscribers[sub.id] = sub
+	return sub
+}
+
+func (b *broker) unsubscribe(sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, sub.id)
+}
+
+// publish offers events to every subscriber whose filter accepts them.
+func (b *broker) publish(events []fingerprintEvent) {
+	b.published.Add(int64(len(events)))
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sub := range b.subscribers {
+		for _, event := range events {
+			if sub.filter != nil && !sub.filter(event) {
+				continue
+			}
+			select {
+			case sub.events <- event:
+			default:
+				b.dropped.Add(1)
+				sub.dropped.Add(1)
+				sub.unreported.Add(1)
+			}
+		}
+	}
+}
+
+func (b *broker) Stats() BrokerStats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	stats := BrokerStats{
+		Published:   b.published.Load(),
+		Delivered:   b.delivered.Load(),
+		Dropped:     b.dropped.Load(),
+		Subscribers: []SubscriberStats{},
+	}
+	for _, sub := range b.subscribers {
+		stats.Subscribers = append(stats.Subscribers, SubscriberStats{
+			ID:         sub.id,
+			RemoteAddr: sub.remoteAddr,
+			Connected:  sub.connected.Format(time.RFC3339),
+			Buffered:   len(sub.events),
+			Delivered:  sub.delivered.Load(),
+			Dropped:    sub.dropped.Load(),
+		})
+	}
+	sort.Slice(stats.Subscribers, func(i, j int) bool {
+		return stats.Subscribers[i].ID < stats.Subscribers[j].ID
+	})
+	return stats
+}
+
+// markDelivered records that an event was written to the subscriber.
+func (sub *subscriber) markDelivered() {
+	sub.delivered.Add(1)
+	sub.broker.delivered.Add(1)
+}
+
+// takeDropped returns the number of events dropped since the last call.
+func (sub *subscriber) takeDropped() int64 {
+	return sub.unreported.Swap(0)
+}
@@ -0,0 +1,273 @@
+// Package config loads the settings of obs, bucket and crdb from command-line
+// flags, environment variables and an optional config file.
+//
+// Every setting is declared as a flag, as usual. Parse then fills in flags
+// that were not given on the command line from the environment and, failing
+// that, from the config file, so the precedence is
+//
+//	command line > environment > config file > flag default
+//
+// The environment variable for a flag is the binary's prefix followed by the
+// flag name in upper case with dashes replaced by underscores, so obs reads
+// -retention-max-age from OBS_RETENTION_MAX_AGE.
+//
+// The config file is named by the -config flag or the PREFIX_CONFIG variable.
+// It uses a subset of TOML:
+//
+//	# comments run to the end of the line
+//	http-addr = ":8080"
+//	store = "sqlite"
+//
+//	[retention]
+//	max-age = "24h"   # durations are strings
+//	max-rows = 10_000
+//
+// Keys in a [section] name the flag "section-key", and underscores in keys
+// are read as dashes. Values are strings in double or single quotes,
+// integers, floats and booleans; arrays, tables and dates are not supported.
+// Unknown keys are errors, so typos do not silently fall back to defaults.
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Parse parses args, normally os.Args[1:], into fs and fills in the flags
+// that were not given from environment variables starting with prefix and
+// from the config file. It registers a -config flag on fs if fs does not
+// already have one.
+func Parse(fs *flag.FlagSet, prefix string, args []string) error {
+	if fs.Lookup("config") == nil {
+		fs.String("config", "", "path to a TOML config file; flags and "+prefix+"_* environment variables take precedence over it")
+	}
+	usage := fs.Usage
+	fs.Usage = func() {
+		usage()
+		fmt.Fprintf(fs.Output(), "\nEvery flag can also be set in the -config file or with the environment variable %s_<FLAG>, such as %s for -config.\n", prefix, envName(prefix, "config"))
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		name := envName(prefix, f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", value, name, setErr)
+			return
+		}
+		set[f.Name] = true
+	})
+	if err != nil {
+		return err
+	}
+
+	path := fs.Lookup("config").Value.String()
+	if path == "" {
+		return nil
+	}
+	settings, err := parseFile(path)
+	if err != nil {
+		return err
+	}
+	for _, s := range settings {
+		if fs.Lookup(s.key) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, s.line, s.key)
+		}
+		if set[s.key] {
+			continue
+		}
+		if err := fs.Set(s.key, s.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, s.line, s.value, s.key, err)
+		}
+	}
+	return nil
+}
+
+func envName(prefix, flagName string) string {
+	return prefix + "_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// ValidateAddr checks that addr, the value of the named flag, is a host:port
+// address to listen on or dial.
+func ValidateAddr(name, addr string) error {
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+		return fmt.Errorf("-%s must be a host:port address, got %q", name, addr)
+	}
+	return nil
+}
+
+// ValidateURL checks that raw, the value of the named flag, is an absolute
+// http or https URL.
+func ValidateURL(name, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("-%s must be an http or https URL, got %q", name, raw)
+	}
+	return nil
+}
+
+// setting is a key and value read from a config file.
+type setting struct {
+	key   string
+	value string
+	line  int
+}
+
+func parseFile(path string) ([]setting, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		settings []setting
+		section  string
+		seen     = map[string]int{}
+	)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, err := stripComment(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			name, ok := strings.CutSuffix(strings.TrimPrefix(line, "["), "]")
+			name = strings.TrimSpace(name)
+			if !ok || !validKey(name) {
+				return nil, fmt.Errorf("%s:%d: invalid section %q", path, n, line)
+			}
+			section = normalizeKey(name)
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !validKey(key) {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		value, err := parseValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+
+		key = normalizeKey(key)
+		if section != "" {
+			key = section + "-" + key
+		}
+		if prev, ok := seen[key]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is already set on line %d", path, n, key, prev)
+		}
+		seen[key] = n
+		settings = append(settings, setting{key: key, value: value, line: n})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// stripComment removes a trailing comment and surrounding space from line,
+// leaving any # inside a quoted string alone.
+func stripComment(line string) (string, error) {
+	var quote rune
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return strings.TrimSpace(line[:i]), nil
+		}
+	}
+	if quote != 0 {
+		return "", fmt.Errorf("unterminated string")
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// validKey reports whether s is a bare TOML key, optionally dotted.
+func validKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, part := range strings.Split(s, ".") {
+		if part == "" {
+			return false
+		}
+		for _, c := range part {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// normalizeKey turns a TOML key into the flag name it sets.
+func normalizeKey(s string) string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(strings.ToLower(s))
+}
+
+// parseValue returns the flag value a TOML value stands for.
+func parseValue(s string) (string, error) {
+	switch {
+	case s == "":
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(s, `"`):
+		value, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return value, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") || strings.Contains(s[1:len(s)-1], "'") {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s == "true" || s == "false":
+		return s, nil
+	}
+
+	// TOML allows underscores between digits for readability.
+	number := strings.ReplaceAll(s, "_", "")
+	if _, err := strconv.ParseInt(number, 10, 64); err == nil {
+		return number, nil
+	}
+	if _, err := strconv.ParseFloat(number, 64); err == nil {
+		return number, nil
+	}
+	return "", fmt.Errorf("unsupported value %s; quote strings and durations", s)
+}
@@ -0,0 +1,246 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: `"plain"`, want: "plain"},
+		{in: `"with spaces"`, want: "with spaces"},
+		{in: `"escaped \"quote\""`, want: `escaped "quote"`},
+		{in: `"tab\there"`, want: "tab\there"},
+		{in: `"24h"`, want: "24h"},
+		{in: `""`, want: ""},
+		{in: `'C:\literal\path'`, want: `C:\literal\path`},
+		{in: `'has "double" quotes'`, want: `has "double" quotes`},
+		{in: `10`, want: "10"},
+		{in: `-3`, want: "-3"},
+		{in: `10_000`, want: "10000"},
+		{in: `1.5`, want: "1.5"},
+		{in: `true`, want: "true"},
+		{in: `false`, want: "false"},
+
+		{in: ``, wantErr: true},
+		{in: `"unterminated`, wantErr: true},
+		{in: `'unterminated`, wantErr: true},
+		{in: `'it's'`, wantErr: true},
+		{in: `bare`, wantErr: true},
+		{in: `24h`, wantErr: true},
+		{in: `True`, wantErr: true},
+		{in: `[1, 2]`, wantErr: true},
+		{in: `["a", "b"]`, wantErr: true},
+		{in: `{ a = 1 }`, wantErr: true},
+		{in: `1979-05-27`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseValue(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseValue(%s) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseValue(%s) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: `# only a comment`, want: ``},
+		{in: `   `, want: ``},
+		{in: `key = 1 # trailing`, want: `key = 1`},
+		{in: `key = 1#tight`, want: `key = 1`},
+		{in: `key = "#not a comment"`, want: `key = "#not a comment"`},
+		{in: `key = 'also # not' # but this is`, want: `key = 'also # not'`},
+		{in: `key = "escaped \" # still a string" # comment`, want: `key = "escaped \" # still a string"`},
+		{in: `key = "it's" # single quote inside double`, want: `key = "it's"`},
+		{in: `key = "unterminated # oops`, wantErr: true},
+		{in: `key = 'unterminated`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := stripComment(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("stripComment(%s) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("stripComment(%s) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func writeFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseFile(t *testing.T) {
+	path := writeFile(t, `
+# obs settings
+http-addr = ":8080"
+store_kind = 'sqlite'   # underscores read as dashes
+
+[retention]
+max-age = "24h"
+max_rows = 10_000
+
+[tls]
+require.client-cert = true
+`)
+	settings, err := parseFile(path)
+	if err != nil {
+		t.Fatalf("parseFile failed: %v", err)
+	}
+
+	want := []setting{
+		{key: "http-addr", value: ":8080", line: 3},
+		{key: "store-kind", value: "sqlite", line: 4},
+		{key: "retention-max-age", value: "24h", line: 7},
+		{key: "retention-max-rows", value: "10000", line: 8},
+		{key: "tls-require-client-cert", value: "true", line: 11},
+	}
+	if len(settings) != len(want) {
+		t.Fatalf("got settings %v, want %v", settings, want)
+	}
+	for i := range want {
+		if settings[i] != want[i] {
+			t.Errorf("setting %d is %v, want %v", i, settings[i], want[i])
+		}
+	}
+}
+
+func TestParseFileErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{"missing equals", "store\n", "config.toml:1: expected key = value"},
+		{"missing key", "= 1\n", "config.toml:1: expected key = value"},
+		{"invalid key", "my key = 1\n", "config.toml:1: expected key = value"},
+		{"missing value", "store =\n", "config.toml:1: missing value"},
+		{"unquoted string", "store = sqlite\n", "config.toml:1: unsupported value sqlite"},
+		{"unquoted duration", "max-age = 24h\n", "config.toml:1: unsupported value 24h"},
+		{"array", "hosts = [\"a\", \"b\"]\n", "config.toml:1: unsupported value"},
+		{"inline table", "tls = { cert = \"a\" }\n", "config.toml:1: unsupported value"},
+		{"unterminated string", "\nstore = \"sqlite\n", "config.toml:2: unterminated string"},
+		{"unclosed section", "[retention\n", "config.toml:1: invalid section"},
+		{"empty section", "[]\n", "config.toml:1: invalid section"},
+		{"array of tables", "[[retention]]\n", "config.toml:1: invalid section"},
+		{"duplicate key", "store = \"a\"\nstore = \"b\"\n", "config.toml:2: store is already set on line 1"},
+		{"duplicate after normalizing", "[retention]\nmax_rows = 1\nmax-rows = 2\n", "config.toml:3: retention-max-rows is already set on line 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseFile(writeFile(t, tt.contents))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// newFlagSet returns a flag set with four string flags, one, two, three and
+// four, all defaulting to "default".
+func newFlagSet() (*flag.FlagSet, map[string]*string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	values := map[string]*string{}
+	for _, name := range []string{"one", "two", "three", "four"} {
+		values[name] = fs.String(name, "default", "")
+	}
+	return fs, values
+}
+
+func TestParsePrecedence(t *testing.T) {
+	path := writeFile(t, "one = \"file\"\ntwo = \"file\"\nthree = \"file\"\n")
+	t.Setenv("TEST_ONE", "env")
+	t.Setenv("TEST_TWO", "env")
+
+	fs, values := newFlagSet()
+	if err := Parse(fs, "TEST", []string{"-config", path, "-one", "flag"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	want := map[string]string{
+		"one":   "flag",
+		"two":   "env",
+		"three": "file",
+		"four":  "default",
+	}
+	for name, value := range want {
+		if got := *values[name]; got != value {
+			t.Errorf("-%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestParseConfigFromEnvironment(t *testing.T) {
+	t.Setenv("TEST_CONFIG", writeFile(t, "one = \"file\"\n"))
+
+	fs, values := newFlagSet()
+	if err := Parse(fs, "TEST", nil); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if got := *values["one"]; got != "file" {
+		t.Errorf("-one = %q, want %q", got, "file")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	t.Run("unknown setting", func(t *testing.T) {
+		fs, _ := newFlagSet()
+		err := Parse(fs, "TEST", []string{"-config", writeFile(t, "five = \"x\"\n")})
+		if err == nil || !strings.Contains(err.Error(), `unknown setting "five"`) {
+			t.Errorf("got error %v, want an unknown setting error", err)
+		}
+	})
+
+	t.Run("invalid value from file", func(t *testing.T) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Int("count", 0, "")
+		err := Parse(fs, "TEST", []string{"-config", writeFile(t, "count = 1.5\n")})
+		if err == nil || !strings.Contains(err.Error(), "config.toml:1: invalid value") {
+			t.Errorf("got error %v, want an invalid value error", err)
+		}
+	})
+
+	t.Run("invalid value from environment", func(t *testing.T) {
+		t.Setenv("TEST_COUNT", "many")
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Int("count", 0, "")
+		err := Parse(fs, "TEST", nil)
+		if err == nil || !strings.Contains(err.Error(), "TEST_COUNT") {
+			t.Errorf("got error %v, want one naming TEST_COUNT", err)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		fs, _ := newFlagSet()
+		if err := Parse(fs, "TEST", []string{"-config", filepath.Join(t.TempDir(), "missing.toml")}); err == nil {
+			t.Error("got no error for a missing config file")
+		}
+	})
+}
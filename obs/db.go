@@ -3,142 +3,326 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
-func initDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./fingerprints.db")
+// sqliteDriverName is the go-sqlite3 driver extended with the REGEXP
+// function, which SQLite parses but leaves to the application to implement.
+const sqliteDriverName = "sqlite3_obs"
+
+func init() {
+	sql.Register(sqliteDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("regexp", sqliteRegexp, true)
+		},
+	})
+}
+
+// lastRegexp caches the most recently compiled REGEXP pattern, since a query
+// evaluates the same pattern against every row.
+var lastRegexp struct {
+	sync.Mutex
+	re *regexp.Regexp
+}
+
+func sqliteRegexp(pattern, s string) (bool, error) {
+	lastRegexp.Lock()
+	re := lastRegexp.re
+	if re == nil || re.String() != pattern {
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			lastRegexp.Unlock()
+			return false, err
+		}
+		lastRegexp.re = re
+	}
+	lastRegexp.Unlock()
+	return re.MatchString(s), nil
+}
+
+// sqliteStore is a Store backed by a SQLite database file.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := initDB(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+		return nil, err
 	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS fingerprints (id INTEGER PRIMARY KEY AUTOINCREMENT, input TEXT, timestamp TEXT)")
+func initDB(path string) (*sql.DB, error) {
+	db, err := sql.Open(sqliteDriverName, path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create table: %v", err)
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	return db, nil
 }
 
-func storeFingerprint(db *sql.DB, input, timestamp string) error {
-	_, err := db.Exec("INSERT INTO fingerprints (input, timestamp) VALUES (?, ?)", input, timestamp)
+func (s *sqliteStore) StoreFingerprints(events []fingerprintEvent) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to insert fingerprint: %v", err)
+		return fmt.Errorf("failed to begin transaction: %v", err)
 	}
+	defer tx.Rollback()
 
-	// Ensure no more than 300 rows
-	err = enforceMaxRows(db, 300)
+	insert, err := tx.Prepare("INSERT INTO fingerprints (fingerprint_id, input, timestamp, unix_time) VALUES (?, ?, ?, ?)")
 	if err != nil {
-		return fmt.Errorf("failed to enforce max rows: %v", err)
+		return fmt.Errorf("failed to prepare insert: %v", err)
 	}
+	defer insert.Close()
 
-	return nil
-}
-
-func enforceMaxRows(db *sql.DB, maxRows int) error {
-	row := db.QueryRow("SELECT COUNT(*) FROM fingerprints")
-	var count int
-	err := row.Scan(&count)
+	upsert, err := tx.Prepare(`INSERT INTO fingerprint_stats (
+			fingerprint_id, bucket_start, input, execution_count, first_seen, last_seen,
+			latency_sum_nanos, latency_min_nanos, latency_max_nanos
+		) VALUES (?, ?, ?, 1, ?, ?, ?, ?, ?)
+		ON CONFLICT (fingerprint_id, bucket_start) DO UPDATE SET
+			execution_count = execution_count + 1,
+			first_seen = MIN(first_seen, excluded.first_seen),
+			last_seen = MAX(last_seen, excluded.last_seen),
+			latency_sum_nanos = latency_sum_nanos + excluded.latency_sum_nanos,
+			latency_min_nanos = MIN(latency_min_nanos, excluded.latency_min_nanos),
+			latency_max_nanos = MAX(latency_max_nanos, excluded.latency_max_nanos)`)
 	if err != nil {
-		return fmt.Errorf("failed to count rows: %v", err)
+		return fmt.Errorf("failed to prepare stats upsert: %v", err)
 	}
+	defer upsert.Close()
 
-	if count > maxRows {
-		_, err := db.Exec("DELETE FROM fingerprints WHERE id = (SELECT id FROM fingerprints ORDER BY timestamp ASC LIMIT 1)")
+	for _, event := range events {
+		// SQLite integers are signed, so the ID is stored as its two's
+		// complement bit pattern.
+		id := int64(event.fingerprintID)
+		ts := event.timestamp.Format(time.RFC3339)
+		_, err = insert.Exec(id, event.input, ts, event.timestamp.Unix())
 		if err != nil {
-			return fmt.Errorf("failed to delete oldest row: %v", err)
+			return fmt.Errorf("failed to insert fingerprint: %v", err)
 		}
-	}
-	return nil
-}
 
-type Fingerprint struct {
-	Input     string `json:"input"`
-	Timestamp string `json:"timestamp"`
-}
+		bucketStart := event.timestamp.Truncate(statsBucketInterval).Format(time.RFC3339)
+		nanos := event.latency.Nanoseconds()
+		_, err = upsert.Exec(id, bucketStart, event.input, ts, ts, nanos, nanos, nanos)
+		if err != nil {
+			return fmt.Errorf("failed to update fingerprint stats: %v", err)
+		}
+	}
 
-type FingerprintPage struct {
-	Fingerprints []Fingerprint `json:"fingerprints"`
-	CurrentPage  int           `json:"current_page"`
-	TotalPages   int           `json:"total_pages"`
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit fingerprints: %v", err)
+	}
+	return nil
 }
 
-func queryFingerprints(db *sql.DB, page, limit int) (FingerprintPage, error) {
-	offset := (page - 1) * limit
-
-	// Count total rows
-	var totalRows int
-	row := db.QueryRow("SELECT COUNT(*) FROM fingerprints")
-	err := row.Scan(&totalRows)
-	if err != nil {
-		return FingerprintPage{}, fmt.Errorf("failed to count rows: %v", err)
+func (s *sqliteStore) QueryFingerprints(q fingerprintsQuery) (FingerprintPage, error) {
+	var (
+		where []string
+		args  []any
+	)
+	if q.after != nil {
+		op := "<"
+		if q.ascending {
+			op = ">"
+		}
+		where = append(where, "(unix_time, id) "+op+" (?, ?)")
+		args = append(args, q.after.unixTime, q.after.id)
+	}
+	if !q.start.IsZero() {
+		where = append(where, "unix_time >= ?")
+		args = append(args, q.start.Unix())
+	}
+	if !q.end.IsZero() {
+		where = append(where, "unix_time < ?")
+		args = append(args, q.end.Unix())
+	}
+	if q.contains != "" {
+		where = append(where, "instr(lower(input), lower(?)) > 0")
+		args = append(args, q.contains)
+	}
+	if q.pattern != nil {
+		where = append(where, "input REGEXP ?")
+		args = append(args, q.pattern.String())
 	}
 
-	totalPages := (totalRows + limit - 1) / limit // Calculate total pages
+	query := "SELECT id, unix_time, fingerprint_id, input, timestamp FROM fingerprints"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if q.ascending {
+		query += " ORDER BY unix_time ASC, id ASC"
+	} else {
+		query += " ORDER BY unix_time DESC, id DESC"
+	}
+	// Fetch one extra row to find out whether there is a next page.
+	query += " LIMIT ?"
+	args = append(args, q.limit+1)
 
-	query := fmt.Sprintf("SELECT input, timestamp FROM fingerprints ORDER BY timestamp DESC LIMIT %d OFFSET %d", limit, offset)
-	rows, err := db.Query(query)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return FingerprintPage{}, fmt.Errorf("failed to query fingerprints: %v", err)
 	}
 	defer rows.Close()
 
-	var fingerprints []Fingerprint
+	page := FingerprintPage{Fingerprints: []Fingerprint{}}
+	var last fingerprintCursor
 	for rows.Next() {
+		if len(page.Fingerprints) == q.limit {
+			page.NextCursor = last.String()
+			break
+		}
+
 		var fp Fingerprint
-		if err := rows.Scan(&fp.Input, &fp.Timestamp); err != nil {
+		var fingerprintID sql.NullInt64
+		if err := rows.Scan(&last.id, &last.unixTime, &fingerprintID, &fp.Input, &fp.Timestamp); err != nil {
 			return FingerprintPage{}, fmt.Errorf("failed to scan row: %v", err)
 		}
-		fingerprints = append(fingerprints, fp)
+		if fingerprintID.Valid {
+			fp.FingerprintID = formatFingerprintID(uint64(fingerprintID.Int64))
+		}
+		page.Fingerprints = append(page.Fingerprints, fp)
+	}
+	if err := rows.Err(); err != nil {
+		return FingerprintPage{}, fmt.Errorf("failed to read fingerprints: %v", err)
 	}
 
-	return FingerprintPage{
-		Fingerprints: fingerprints,
-		CurrentPage:  page,
-		TotalPages:   totalPages,
-	}, nil
+	return page, nil
 }
 
-type IntervalCount struct {
-	Timestamp string `json:"timestamp"`
-	Count     int    `json:"count"`
-}
+func (s *sqliteStore) IntervalCounts(q intervalCountsQuery) ([]IntervalCount, error) {
+	first, end, step := q.bucketRange()
 
-func getIntervalCounts(db *sql.DB) ([]IntervalCount, error) {
-	rows, err := db.Query("SELECT timestamp FROM fingerprints ORDER BY timestamp ASC")
+	query := `SELECT unix_time / ? * ? AS bucket, COUNT(*)
+		FROM fingerprints
+		WHERE unix_time >= ? AND unix_time < ?`
+	args := []any{step, step, first, end}
+	if len(q.fingerprintIDs) > 0 {
+		query += " AND fingerprint_id IN (?" + strings.Repeat(", ?", len(q.fingerprintIDs)-1) + ")"
+		for _, id := range q.fingerprintIDs {
+			args = append(args, int64(id))
+		}
+	}
+	query += " GROUP BY bucket ORDER BY bucket"
+
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query timestamps: %v", err)
+		return nil, fmt.Errorf("failed to query interval counts: %v", err)
 	}
 	defer rows.Close()
 
-	var counts []IntervalCount
-	var timestamp string
+	countsByBucket := make(map[int64]int)
 	for rows.Next() {
-		err := rows.Scan(&timestamp)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan timestamp: %v", err)
+		var bucket int64
+		var count int
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan interval count: %v", err)
 		}
+		countsByBucket[bucket] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read interval counts: %v", err)
+	}
 
-		t, err := time.Parse(time.RFC3339, timestamp)
+	return zeroFilledCounts(q, countsByBucket), nil
+}
+
+func (s *sqliteStore) FingerprintStats(fingerprintID uint64) (FingerprintStats, error) {
+	rows, err := s.db.Query(`SELECT bucket_start, input, execution_count, first_seen, last_seen,
+			latency_sum_nanos, latency_min_nanos, latency_max_nanos
+		FROM fingerprint_stats WHERE fingerprint_id = ? ORDER BY bucket_start ASC`, int64(fingerprintID))
+	if err != nil {
+		return FingerprintStats{}, fmt.Errorf("failed to query fingerprint stats: %v", err)
+	}
+	defer rows.Close()
+
+	var (
+		input   string
+		buckets []StatsBucket
+	)
+	for rows.Next() {
+		var b StatsBucket
+		err := rows.Scan(&b.BucketStart, &input, &b.ExecutionCount, &b.FirstSeen, &b.LastSeen,
+			&b.LatencySumNanos, &b.LatencyMinNanos, &b.LatencyMaxNanos)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse timestamp: %v", err)
+			return FingerprintStats{}, fmt.Errorf("failed to scan fingerprint stats: %v", err)
 		}
+		buckets = append(buckets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return FingerprintStats{}, fmt.Errorf("failed to read fingerprint stats: %v", err)
+	}
 
-		intervalKey := t.Truncate(30 * time.Second).Format("2006-01-02 15:04:05")
-		found := false
-		for i, count := range counts {
-			if count.Timestamp == intervalKey {
-				counts[i].Count++
-				found = true
-				break
-			}
-		}
-		if !found {
-			counts = append(counts, IntervalCount{Timestamp: intervalKey, Count: 1})
-		}
+	if len(buckets) == 0 {
+		return FingerprintStats{}, errFingerprintNotFound
 	}
+	return newFingerprintStats(fingerprintID, input, buckets), nil
+}
+
+func (s *sqliteStore) CountFingerprints() (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM fingerprints").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count rows: %v", err)
+	}
+	return count, nil
+}
+
+// SizeBytes returns the size of the pages in use. Pages freed by deletes are
+// excluded, since SQLite reuses them for later inserts.
+func (s *sqliteStore) SizeBytes() (int64, error) {
+	var size int64
+	err := s.db.QueryRow(`SELECT (page_count - freelist_count) * page_size
+		FROM pragma_page_count(), pragma_freelist_count(), pragma_page_size()`).Scan(&size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read database size: %v", err)
+	}
+	return size, nil
+}
 
-	return counts, nil
+func (s *sqliteStore) DeleteFingerprintsBefore(cutoff time.Time, limit int) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM fingerprints WHERE id IN (
+			SELECT id FROM fingerprints
+			WHERE unix_time < ?
+			ORDER BY id ASC LIMIT ?
+		)`, cutoff.Unix(), limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired rows: %v", err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *sqliteStore) DeleteOldestFingerprints(n int) (int, error) {
+	res, err := s.db.Exec("DELETE FROM fingerprints WHERE id IN (SELECT id FROM fingerprints ORDER BY id ASC LIMIT ?)", n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete oldest rows: %v", err)
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+func (s *sqliteStore) DeleteStatsBefore(cutoff time.Time) (int, error) {
+	// A bucket ends statsBucketInterval after it starts.
+	res, err := s.db.Exec("DELETE FROM fingerprint_stats WHERE CAST(strftime('%s', bucket_start) AS INTEGER) < ?",
+		cutoff.Add(-statsBucketInterval).Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired stats: %v", err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
 }
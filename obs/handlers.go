@@ -2,36 +2,228 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
+// registerAPI adds the HTTP API routes to r under /api.
+func (s *server) registerAPI(r *mux.Router) {
+	apiRouter := r.PathPrefix("/api").Subrouter()
+	apiRouter.HandleFunc("/fingerprints", s.listFingerprints).Methods("GET")
+	apiRouter.HandleFunc("/fingerprints/count", s.listFingerprintCounts).Methods("GET")
+	apiRouter.HandleFunc("/fingerprints/stream", s.streamFingerprints).Methods("GET")
+	apiRouter.HandleFunc("/fingerprints/stream/stats", s.getStreamStats).Methods("GET")
+	apiRouter.HandleFunc("/fingerprints/{id}/stats", s.getFingerprintStats).Methods("GET")
+	apiRouter.HandleFunc("/retention", s.getRetentionStats).Methods("GET")
+	apiRouter.HandleFunc("/ui", s.getUIStatus).Methods("GET")
+	apiRouter.HandleFunc("/ui/reload", localOnly(s.reloadUI)).Methods("POST")
+	apiRouter.HandleFunc("/health", s.health).Methods("GET")
+}
+
 func (s *server) health(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *server) listFingerprints(w http.ResponseWriter, r *http.Request) {
-	page, err := strconv.Atoi(r.URL.Query().Get("page"))
-	if err != nil || page < 1 {
-		page = 1
+const (
+	// defaultFingerprintsLimit is the page size used when the limit
+	// parameter is omitted.
+	defaultFingerprintsLimit = 20
+	// maxFingerprintsLimit bounds the page size a single request can ask
+	// for.
+	maxFingerprintsLimit = 1000
+)
+
+// parseFingerprintsQuery reads the limit, cursor, q, regex, start, end and
+// order query parameters of /api/fingerprints. q is a case-insensitive
+// substring and regex a Go regular expression, both matched against the
+// statement text. start and end are RFC 3339 timestamps, and order is asc or
+// desc (the default, newest first).
+func parseFingerprintsQuery(r *http.Request) (fingerprintsQuery, error) {
+	params := r.URL.Query()
+	q := fingerprintsQuery{limit: defaultFingerprintsLimit}
+
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return q, fmt.Errorf("invalid limit %q", v)
+		}
+		q.limit = min(limit, maxFingerprintsLimit)
+	}
+
+	if v := params.Get("cursor"); v != "" {
+		cursor, err := parseFingerprintCursor(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid cursor %q", v)
+		}
+		q.after = &cursor
+	}
+
+	switch v := params.Get("order"); v {
+	case "", "desc":
+	case "asc":
+		q.ascending = true
+	default:
+		return q, fmt.Errorf("invalid order %q", v)
+	}
+
+	if err := parseInputFilters(params, &q); err != nil {
+		return q, err
+	}
+
+	if v := params.Get("start"); v != "" {
+		start, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("invalid start %q", v)
+		}
+		q.start = start
 	}
-	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
-	if err != nil || limit < 1 {
-		limit = 20
+	if v := params.Get("end"); v != "" {
+		end, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("invalid end %q", v)
+		}
+		q.end = end
+	}
+	if !q.start.IsZero() && !q.end.IsZero() && !q.start.Before(q.end) {
+		return q, fmt.Errorf("start must be before end")
+	}
+
+	return q, nil
+}
+
+// parseInputFilters reads the q and regex query parameters, which match
+// against the statement text, into q.
+func parseInputFilters(params url.Values, q *fingerprintsQuery) error {
+	q.contains = params.Get("q")
+	if v := params.Get("regex"); v != "" {
+		pattern, err := regexp.Compile(v)
+		if err != nil {
+			return fmt.Errorf("invalid regex %q: %v", v, err)
+		}
+		q.pattern = pattern
+	}
+	return nil
+}
+
+// parseFingerprintIDs reads the fingerprint query parameter, which may be
+// repeated or comma-separated.
+func parseFingerprintIDs(params url.Values) ([]uint64, error) {
+	var fingerprintIDs []uint64
+	for _, v := range params["fingerprint"] {
+		for _, id := range strings.Split(v, ",") {
+			fingerprintID, err := parseFingerprintID(id)
+			if err != nil {
+				return nil, fmt.Errorf("invalid fingerprint %q", id)
+			}
+			fingerprintIDs = append(fingerprintIDs, fingerprintID)
+		}
+	}
+	return fingerprintIDs, nil
+}
+
+func (s *server) listFingerprints(w http.ResponseWriter, r *http.Request) {
+	q, err := parseFingerprintsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	fingerprintPage, err := queryFingerprints(s.db, page, limit)
+	fingerprintPage, err := s.store.QueryFingerprints(q)
 	if err != nil {
 		http.Error(w, "Failed to query fingerprints", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(fingerprintPage)
 }
 
+const (
+	// defaultCountInterval is the bucket width used when the interval
+	// parameter is omitted.
+	defaultCountInterval = 30 * time.Second
+	// defaultCountBuckets is the number of buckets returned when the start
+	// parameter is omitted.
+	defaultCountBuckets = 120
+	// maxCountBuckets bounds the number of buckets a single request can ask
+	// for.
+	maxCountBuckets = 10000
+)
+
+// parseIntervalCountsQuery reads the start, end, interval and fingerprint
+// query parameters of /api/fingerprints/count. start and end are RFC 3339
+// timestamps, interval is a Go duration such as 10s, 1m or 1h, and
+// fingerprint may be repeated or comma-separated.
+func parseIntervalCountsQuery(r *http.Request) (intervalCountsQuery, error) {
+	params := r.URL.Query()
+	q := intervalCountsQuery{
+		end:      time.Now(),
+		interval: defaultCountInterval,
+	}
+
+	if v := params.Get("interval"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid interval %q", v)
+		}
+		if interval < time.Second || interval%time.Second != 0 {
+			return q, fmt.Errorf("interval must be a whole number of seconds")
+		}
+		q.interval = interval
+	}
+
+	if v := params.Get("end"); v != "" {
+		end, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("invalid end %q", v)
+		}
+		q.end = end
+	}
+
+	q.start = q.end.Add(-defaultCountBuckets * q.interval)
+	if v := params.Get("start"); v != "" {
+		start, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, fmt.Errorf("invalid start %q", v)
+		}
+		q.start = start
+	}
+
+	if !q.start.Before(q.end) {
+		return q, fmt.Errorf("start must be before end")
+	}
+	if q.end.Sub(q.start)/q.interval > maxCountBuckets {
+		return q, fmt.Errorf("range covers more than %d intervals", maxCountBuckets)
+	}
+
+	fingerprintIDs, err := parseFingerprintIDs(params)
+	if err != nil {
+		return q, err
+	}
+	q.fingerprintIDs = fingerprintIDs
+
+	return q, nil
+}
+
 func (s *server) listFingerprintCounts(w http.ResponseWriter, r *http.Request) {
-	counts, err := getIntervalCounts(s.db)
+	q, err := parseIntervalCountsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	counts, err := s.store.IntervalCounts(q)
 	if err != nil {
-		println(err.Error())
+		log.Printf("Failed to count statements: %v", err)
 		http.Error(w, "Failed to count statements", http.StatusInternalServerError)
 		return
 	}
@@ -39,3 +231,175 @@ func (s *server) listFingerprintCounts(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(counts)
 }
+
+func (s *server) getFingerprintStats(w http.ResponseWriter, r *http.Request) {
+	fingerprintID, err := parseFingerprintID(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid fingerprint ID", http.StatusBadRequest)
+		return
+	}
+
+	stats, err := s.store.FingerprintStats(fingerprintID)
+	if errors.Is(err, errFingerprintNotFound) {
+		http.Error(w, "Fingerprint not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to query fingerprint stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// streamHeartbeatInterval is how often an idle stream sends a comment, so
+// that proxies do not time out the connection.
+const streamHeartbeatInterval = 15 * time.Second
+
+// parseStreamFilter builds the subscriber filter for the q, regex and
+// fingerprint query parameters of /api/fingerprints/stream.
+func parseStreamFilter(r *http.Request) (func(fingerprintEvent) bool, error) {
+	params := r.URL.Query()
+	var q fingerprintsQuery
+	if err := parseInputFilters(params, &q); err != nil {
+		return nil, err
+	}
+
+	fingerprintIDs, err := parseFingerprintIDs(params)
+	if err != nil {
+		return nil, err
+	}
+	var wanted map[uint64]bool
+	if len(fingerprintIDs) > 0 {
+		wanted = make(map[uint64]bool, len(fingerprintIDs))
+		for _, id := range fingerprintIDs {
+			wanted[id] = true
+		}
+	}
+
+	return func(event fingerprintEvent) bool {
+		return (wanted == nil || wanted[event.fingerprintID]) && q.matches(event)
+	}, nil
+}
+
+// streamFingerprints sends fingerprints as Server-Sent Events as they are
+// stored. Each one is a "fingerprint" event whose data is the same object
+// listed by /api/fingerprints. A client that falls further behind than its
+// buffer allows misses fingerprints, and is sent a "dropped" event with the
+// number missed before the next fingerprint.
+func (s *server) streamFingerprints(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseStreamFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := s.broker.subscribe(r.RemoteAddr, filter)
+	defer s.broker.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx and similar proxies from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case event := <-sub.events:
+			if dropped := sub.takeDropped(); dropped > 0 {
+				err = writeServerSentEvent(w, "dropped", map[string]int64{"dropped": dropped})
+			}
+			if err == nil {
+				err = writeServerSentEvent(w, "fingerprint", event.fingerprint())
+				sub.markDelivered()
+			}
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeServerSentEvent(w http.ResponseWriter, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
+
+func (s *server) getStreamStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.broker.Stats())
+}
+
+func (s *server) getRetentionStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.retainer.Stats())
+}
+
+func (s *server) getUIStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.bundles.Status())
+}
+
+// localOnly rejects requests to h unless they come from the UI obs serves, a
+// UI served from the same machine, such as a development server, or a client
+// on the same machine that is not a browser. Other web pages could otherwise
+// make a visitor's browser call h, since a cross-origin POST is sent even
+// though CORS keeps the page from reading the response.
+func localOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Host != r.Host && !isLoopback(u.Hostname())) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err != nil || !isLoopback(host) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// isLoopback reports whether host names or is an address of this machine's
+// loopback interface.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// reloadUI checks the bucket server for a newer UI bundle right away, for
+// example after a release, instead of waiting for the next poll.
+func (s *server) reloadUI(w http.ResponseWriter, r *http.Request) {
+	status, err := s.bundles.Reload(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reload UI bundle: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
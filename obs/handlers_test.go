@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lassenordahl/disaggui/obs/uihandler"
+)
+
+// base is the time the test fingerprints are recorded relative to. It is on
+// an hour boundary, so they all land in the same stats bucket.
+var base = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestServer returns a server backed by a store from open holding three
+// events: two executions of fingerprint 1 and one of fingerprint 2, a minute
+// apart.
+func newTestServer(t *testing.T, open func(t *testing.T) Store) *server {
+	t.Helper()
+	store := open(t)
+	err := store.StoreFingerprints([]fingerprintEvent{
+		{fingerprintID: 1, input: "SELECT * FROM users WHERE id = _", timestamp: base, latency: 10 * time.Millisecond},
+		{fingerprintID: 2, input: "INSERT INTO orders VALUES (_, __more__)", timestamp: base.Add(time.Minute), latency: 5 * time.Millisecond},
+		{fingerprintID: 1, input: "SELECT * FROM users WHERE id = _", timestamp: base.Add(2 * time.Minute), latency: 30 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("failed to store fingerprints: %v", err)
+	}
+	return &server{store: store, broker: newBroker(1)}
+}
+
+// serve sends a GET request for target to s's API and returns the response.
+func serve(s *server, target string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	s.registerAPI(r)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func decode[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.NewDecoder(w.Body).Decode(&v); err != nil {
+		t.Fatalf("failed to decode response %q: %v", w.Body.String(), err)
+	}
+	return v
+}
+
+func TestHealth(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		s := newTestServer(t, open)
+		if w := serve(s, "/api/health"); w.Code != http.StatusOK {
+			t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+	})
+}
+
+func TestListFingerprints(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		s := newTestServer(t, open)
+
+		tests := []struct {
+			name  string
+			query string
+			want  []string
+		}{
+			{"newest first", "", []string{"0000000000000001", "0000000000000002", "0000000000000001"}},
+			{"substring", "q=insert", []string{"0000000000000002"}},
+			{"regex", "regex=^SELECT", []string{"0000000000000001", "0000000000000001"}},
+			{"time range", "start=" + url.QueryEscape(base.Add(time.Minute).Format(time.RFC3339)), []string{"0000000000000001", "0000000000000002"}},
+			{"no match", "q=nothing", []string{}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				w := serve(s, "/api/fingerprints?"+tt.query)
+				if w.Code != http.StatusOK {
+					t.Fatalf("got status %d: %s", w.Code, w.Body)
+				}
+				page := decode[FingerprintPage](t, w)
+				var got []string
+				for _, fp := range page.Fingerprints {
+					got = append(got, fp.FingerprintID)
+				}
+				if len(got) != len(tt.want) {
+					t.Fatalf("got fingerprints %v, want %v", got, tt.want)
+				}
+				for i := range got {
+					if got[i] != tt.want[i] {
+						t.Fatalf("got fingerprints %v, want %v", got, tt.want)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestListFingerprintsOrder(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		s := newTestServer(t, open)
+		page := decode[FingerprintPage](t, serve(s, "/api/fingerprints?order=asc"))
+		var got []string
+		for _, fp := range page.Fingerprints {
+			got = append(got, fp.Timestamp)
+		}
+		want := []string{
+			base.Format(time.RFC3339),
+			base.Add(time.Minute).Format(time.RFC3339),
+			base.Add(2 * time.Minute).Format(time.RFC3339),
+		}
+		if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+			t.Errorf("got timestamps %v, want %v", got, want)
+		}
+	})
+}
+
+func TestListFingerprintsPagination(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		s := newTestServer(t, open)
+
+		first := decode[FingerprintPage](t, serve(s, "/api/fingerprints?limit=2"))
+		if len(first.Fingerprints) != 2 || first.NextCursor == "" {
+			t.Fatalf("got %d fingerprints and cursor %q, want 2 and a cursor", len(first.Fingerprints), first.NextCursor)
+		}
+		second := decode[FingerprintPage](t, serve(s, "/api/fingerprints?limit=2&cursor="+first.NextCursor))
+		if len(second.Fingerprints) != 1 || second.NextCursor != "" {
+			t.Fatalf("got %d fingerprints and cursor %q, want 1 and no cursor", len(second.Fingerprints), second.NextCursor)
+		}
+		if got, want := second.Fingerprints[0].Timestamp, base.Format(time.RFC3339); got != want {
+			t.Errorf("last page has timestamp %s, want %s", got, want)
+		}
+	})
+}
+
+func TestListFingerprintsBadRequest(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		s := newTestServer(t, open)
+
+		for _, query := range []string{
+			"limit=0",
+			"limit=ten",
+			"cursor=%21%21",
+			"order=sideways",
+			"regex=%28",
+			"start=yesterday",
+			"end=2024-05-01",
+			"start=2024-05-01T12:00:00Z&end=2024-05-01T12:00:00Z",
+		} {
+			t.Run(query, func(t *testing.T) {
+				if w := serve(s, "/api/fingerprints?"+query); w.Code != http.StatusBadRequest {
+					t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+				}
+			})
+		}
+	})
+}
+
+func TestListFingerprintCounts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		s := newTestServer(t, open)
+		start := url.QueryEscape(base.Format(time.RFC3339))
+		end := url.QueryEscape(base.Add(3 * time.Minute).Format(time.RFC3339))
+
+		tests := []struct {
+			name  string
+			query string
+			want  []int
+		}{
+			{"all", "interval=1m", []int{1, 1, 1}},
+			{"wide interval", "interval=3m", []int{3}},
+			{"one fingerprint", "interval=1m&fingerprint=1", []int{1, 0, 1}},
+			{"several fingerprints", "interval=1m&fingerprint=1,2", []int{1, 1, 1}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				w := serve(s, "/api/fingerprints/count?start="+start+"&end="+end+"&"+tt.query)
+				if w.Code != http.StatusOK {
+					t.Fatalf("got status %d: %s", w.Code, w.Body)
+				}
+				counts := decode[[]IntervalCount](t, w)
+				var got []int
+				for _, c := range counts {
+					got = append(got, c.Count)
+				}
+				if len(got) != len(tt.want) {
+					t.Fatalf("got counts %v, want %v", got, tt.want)
+				}
+				for i := range got {
+					if got[i] != tt.want[i] {
+						t.Fatalf("got counts %v, want %v", got, tt.want)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestListFingerprintCountsBadRequest(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		s := newTestServer(t, open)
+
+		for _, query := range []string{
+			"interval=soon",
+			"interval=1500ms",
+			"interval=500ms",
+			"start=yesterday",
+			"end=tomorrow",
+			"start=2024-05-01T12:00:00Z&end=2024-05-01T11:00:00Z",
+			"start=2000-01-01T00:00:00Z&end=2024-01-01T00:00:00Z&interval=1s",
+			"fingerprint=xyz",
+		} {
+			t.Run(query, func(t *testing.T) {
+				if w := serve(s, "/api/fingerprints/count?"+query); w.Code != http.StatusBadRequest {
+					t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+				}
+			})
+		}
+	})
+}
+
+func TestFingerprintStats(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		s := newTestServer(t, open)
+
+		w := serve(s, "/api/fingerprints/0000000000000001/stats")
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body)
+		}
+		stats := decode[FingerprintStats](t, w)
+		if stats.FingerprintID != "0000000000000001" || stats.Input != "SELECT * FROM users WHERE id = _" {
+			t.Errorf("got stats for %s %q", stats.FingerprintID, stats.Input)
+		}
+		if len(stats.Buckets) != 1 {
+			t.Fatalf("got %d buckets, want 1", len(stats.Buckets))
+		}
+		total := stats.Total
+		if total.ExecutionCount != 2 {
+			t.Errorf("got execution count %d, want 2", total.ExecutionCount)
+		}
+		if total.LatencyMinNanos != int64(10*time.Millisecond) || total.LatencyMaxNanos != int64(30*time.Millisecond) || total.LatencyMeanNanos != int64(20*time.Millisecond) {
+			t.Errorf("got latency min %d, max %d, mean %d", total.LatencyMinNanos, total.LatencyMaxNanos, total.LatencyMeanNanos)
+		}
+	})
+}
+
+func TestFingerprintStatsErrors(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		s := newTestServer(t, open)
+
+		tests := []struct {
+			name string
+			id   string
+			want int
+		}{
+			{"unknown", "00000000000000ff", http.StatusNotFound},
+			{"not hex", "xyz", http.StatusBadRequest},
+			{"too long", "10000000000000000", http.StatusBadRequest},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if w := serve(s, "/api/fingerprints/"+tt.id+"/stats"); w.Code != tt.want {
+					t.Errorf("got status %d, want %d", w.Code, tt.want)
+				}
+			})
+		}
+	})
+}
+
+// failingStore is a memStore whose queries fail.
+type failingStore struct {
+	*memStore
+}
+
+var errStoreFailed = errors.New("store failed")
+
+func (failingStore) QueryFingerprints(fingerprintsQuery) (FingerprintPage, error) {
+	return FingerprintPage{}, errStoreFailed
+}
+
+func (failingStore) IntervalCounts(intervalCountsQuery) ([]IntervalCount, error) {
+	return nil, errStoreFailed
+}
+
+func (failingStore) FingerprintStats(uint64) (FingerprintStats, error) {
+	return FingerprintStats{}, errStoreFailed
+}
+
+func TestStoreErrors(t *testing.T) {
+	s := &server{store: failingStore{newMemStore(100)}, broker: newBroker(1)}
+
+	for _, target := range []string{
+		"/api/fingerprints",
+		"/api/fingerprints/count",
+		"/api/fingerprints/0000000000000001/stats",
+	} {
+		t.Run(target, func(t *testing.T) {
+			if w := serve(s, target); w.Code != http.StatusInternalServerError {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+			}
+		})
+	}
+}
+
+func TestReloadUIOrigin(t *testing.T) {
+	// Nothing listens on port 1, so reloads that are let through fail
+	// quickly instead of reaching a real bucket server.
+	old := uihandler.BucketURL
+	uihandler.BucketURL = "http://127.0.0.1:1"
+	t.Cleanup(func() { uihandler.BucketURL = old })
+
+	s := &server{store: newMemStore(100), broker: newBroker(1), bundles: uihandler.NewWatcher("~1.0", 0)}
+	r := mux.NewRouter()
+	s.registerAPI(r)
+
+	tests := []struct {
+		name       string
+		origin     string
+		remoteAddr string
+		allowed    bool
+	}{
+		{"same origin", "http://obs.example.com:8080", "192.0.2.1:1234", true},
+		{"loopback origin", "http://localhost:5173", "127.0.0.1:1234", true},
+		{"loopback address origin", "http://[::1]:5173", "[::1]:1234", true},
+		{"other origin", "https://attacker.example", "127.0.0.1:1234", false},
+		{"null origin", "null", "127.0.0.1:1234", false},
+		{"local client", "", "127.0.0.1:1234", true},
+		{"remote client", "", "192.0.2.1:1234", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://obs.example.com:8080/api/ui/reload", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if forbidden := w.Code == http.StatusForbidden; forbidden == tt.allowed {
+				t.Errorf("got status %d, want allowed = %v", w.Code, tt.allowed)
+			}
+		})
+	}
+}
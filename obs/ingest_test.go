@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/lassenordahl/disaggui/obs/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newIngestClient serves the ingestion API backed by a SQLite store in a
+// temporary directory over an in-memory connection, and returns a client for
+// it. Every RPC is acknowledged only after the store has been written to, so
+// benchmarks using the client cover the full ingest path.
+func newIngestClient(b *testing.B) pb.CRDBServiceClient {
+	b.Helper()
+
+	// The store logs its migrations and the handlers log every call, which
+	// would drown out the results.
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(out) })
+
+	store, err := newSQLiteStore(filepath.Join(b.TempDir(), "fingerprints.db"))
+	if err != nil {
+		b.Fatalf("failed to open store: %v", err)
+	}
+	b.Cleanup(func() { store.Close() })
+
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	pb.RegisterCRDBServiceServer(s, &server{store: store, broker: newBroker(1)})
+	go s.Serve(lis)
+	b.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		b.Fatalf("failed to connect: %v", err)
+	}
+	b.Cleanup(func() { conn.Close() })
+
+	return pb.NewCRDBServiceClient(conn)
+}
+
+func benchFingerprints(n int) []*pb.Fingerprint {
+	fingerprints := make([]*pb.Fingerprint, n)
+	for i := range fingerprints {
+		fingerprints[i] = &pb.Fingerprint{
+			Input:         fmt.Sprintf("SELECT * FROM bench_%d WHERE id = _", i%10),
+			FingerprintId: uint64(i % 10),
+			LatencyNanos:  int64(i),
+		}
+	}
+	return fingerprints
+}
+
+// BenchmarkIngestUnary sends each fingerprint with its own ProcessFingerprint
+// call.
+func BenchmarkIngestUnary(b *testing.B) {
+	client := newIngestClient(b)
+	fingerprints := benchFingerprints(b.N)
+	b.ResetTimer()
+
+	for _, fp := range fingerprints {
+		if _, err := client.ProcessFingerprint(context.Background(), fp); err != nil {
+			b.Fatalf("ProcessFingerprint failed: %v", err)
+		}
+	}
+}
+
+// BenchmarkIngestStream sends fingerprints over StreamFingerprints, one
+// stream per batch, for a range of batch sizes.
+func BenchmarkIngestStream(b *testing.B) {
+	for _, batchSize := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			client := newIngestClient(b)
+			fingerprints := benchFingerprints(b.N)
+			b.ResetTimer()
+
+			for i := 0; i < len(fingerprints); i += batchSize {
+				stream, err := client.StreamFingerprints(context.Background())
+				if err != nil {
+					b.Fatalf("StreamFingerprints failed: %v", err)
+				}
+				for _, fp := range fingerprints[i:min(i+batchSize, len(fingerprints))] {
+					if err := stream.Send(fp); err != nil {
+						b.Fatalf("failed to send fingerprint: %v", err)
+					}
+				}
+				if _, err := stream.CloseAndRecv(); err != nil {
+					b.Fatalf("failed to close stream: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// lifecycle runs obs's servers and background workers under one context and
+// shuts them down in order when obs receives SIGINT or SIGTERM, or when a
+// server fails:
+//
+//  1. The context is cancelled, stopping workers and ending live streams.
+//  2. Servers stop accepting work and drain in-flight requests.
+//  3. Once workers have returned, closers run in reverse order, so the store
+//     is closed only after every write to it has finished.
+//
+// Steps 2 and 3 share the shutdown timeout. Servers that have not drained by
+// then are stopped forcefully. Their handlers, or workers that have not
+// returned, may still be using what the closers would close, so the closers
+// are skipped in that case and the process exits without them.
+type lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// stopSignals stops relaying signals to ctx, so that a second signal
+	// kills obs without waiting for the shutdown to finish.
+	stopSignals context.CancelFunc
+
+	// failed receives the first error a server returns from serving.
+	failed chan error
+
+	servers []lifecycleServer
+	workers sync.WaitGroup
+	closers []lifecycleCloser
+}
+
+type lifecycleServer struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+type lifecycleCloser struct {
+	name  string
+	close func() error
+}
+
+func newLifecycle() *lifecycle {
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(signalCtx)
+	return &lifecycle{
+		ctx:         ctx,
+		cancel:      cancel,
+		stopSignals: stopSignals,
+		failed:      make(chan error, 1),
+	}
+}
+
+// serve runs serve in the background until shutdown, when stop is called to
+// drain it. stop must return nil only if every in-flight request has finished.
+// serve must return nil once stop has been called. Any other return shuts obs
+// down.
+func (l *lifecycle) serve(name string, serve func() error, stop func(ctx context.Context) error) {
+	l.servers = append(l.servers, lifecycleServer{name: name, stop: stop})
+	go func() {
+		err := serve()
+		if err == nil && l.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("stopped unexpectedly")
+		}
+		select {
+		case l.failed <- fmt.Errorf("%s server: %v", name, err):
+		default:
+		}
+	}()
+}
+
+// goWorker runs run in the background. Its context is cancelled on shutdown,
+// and the shutdown waits for it to return.
+func (l *lifecycle) goWorker(run func(ctx context.Context)) {
+	l.workers.Add(1)
+	go func() {
+		defer l.workers.Done()
+		run(l.ctx)
+	}()
+}
+
+// onClose registers close to run at the end of the shutdown, after servers
+// and workers have stopped.
+func (l *lifecycle) onClose(name string, close func() error) {
+	l.closers = append(l.closers, lifecycleCloser{name: name, close: close})
+}
+
+// wait blocks until obs is asked to stop or a server fails, then shuts
+// everything down, allowing timeout for servers and workers to finish. It
+// returns the error that caused the shutdown, if any.
+func (l *lifecycle) wait(timeout time.Duration) error {
+	var cause error
+	select {
+	case <-l.ctx.Done():
+		log.Printf("Shutting down, waiting up to %s for in-flight requests", timeout)
+	case cause = <-l.failed:
+		log.Printf("Shutting down: %v", cause)
+	}
+	l.stopSignals()
+	l.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Workers stop as soon as l.ctx is cancelled, so they are waited for
+	// while the servers drain.
+	workersDone := make(chan struct{})
+	go func() {
+		l.workers.Wait()
+		close(workersDone)
+	}()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		drained = true
+	)
+	for _, s := range l.servers {
+		wg.Add(1)
+		go func(s lifecycleServer) {
+			defer wg.Done()
+			if err := s.stop(ctx); err != nil {
+				log.Printf("Failed to stop %s server gracefully: %v", s.name, err)
+				mu.Lock()
+				drained = false
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+	}
+	// ctx may have expired while the servers were stopping, so check the
+	// workers separately rather than letting select pick either case.
+	select {
+	case <-workersDone:
+	default:
+		log.Printf("Background workers did not stop in %s", timeout)
+		drained = false
+	}
+
+	if !drained {
+		for i := len(l.closers) - 1; i >= 0; i-- {
+			log.Printf("Not closing %s, since requests or workers may still be using it", l.closers[i].name)
+		}
+		return cause
+	}
+	for i := len(l.closers) - 1; i >= 0; i-- {
+		c := l.closers[i]
+		if err := c.close(); err != nil {
+			log.Printf("Failed to close %s: %v", c.name, err)
+		}
+	}
+	return cause
+}
@@ -2,79 +2,333 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lassenordahl/disaggui/obs/config"
 	pb "github.com/lassenordahl/disaggui/obs/proto"
+	"github.com/lassenordahl/disaggui/obs/tlsconfig"
 	"github.com/lassenordahl/disaggui/obs/uihandler"
 	"github.com/rs/cors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 type server struct {
 	pb.UnimplementedCRDBServiceServer
-	db *sql.DB
+	store    Store
+	retainer *retainer
+	broker   *broker
+	bundles  *uihandler.Watcher
 }
 
 func (s *server) ProcessFingerprint(ctx context.Context, req *pb.Fingerprint) (*pb.Ack, error) {
-	timestamp := time.Now().Format(time.RFC3339)
-	req.Timestamp = timestamp
-
-	err := storeFingerprint(s.db, req.GetInput(), timestamp)
+	event := newFingerprintEvent(req)
+	err := s.store.StoreFingerprints([]fingerprintEvent{event})
 	if err != nil {
 		return nil, err
 	}
+	s.broker.publish([]fingerprintEvent{event})
 
-	log.Printf("Stored fingerprint: %s at %s", req.GetInput(), timestamp)
+	log.Printf("Stored fingerprint %s: %s at %s", formatFingerprintID(req.GetFingerprintId()), req.GetInput(), req.GetTimestamp())
 	return &pb.Ack{Message: "Fingerprint processed"}, nil
 }
 
-func main() {
-	db, err := initDB()
+// streamBatchSize is the number of fingerprints StreamFingerprints writes
+// per transaction.
+const streamBatchSize = 500
+
+func (s *server) StreamFingerprints(stream pb.CRDBService_StreamFingerprintsServer) error {
+	var (
+		batch []fingerprintEvent
+		total int
+	)
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		batch = append(batch, newFingerprintEvent(req))
+		if len(batch) >= streamBatchSize {
+			if err := s.store.StoreFingerprints(batch); err != nil {
+				return err
+			}
+			s.broker.publish(batch)
+			total += len(batch)
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := s.store.StoreFingerprints(batch); err != nil {
+			return err
+		}
+		s.broker.publish(batch)
+		total += len(batch)
+	}
+
+	log.Printf("Stored %d streamed fingerprints", total)
+	return stream.SendAndClose(&pb.Ack{Message: fmt.Sprintf("%d fingerprints processed", total)})
+}
+
+// newFingerprintEvent converts req to the event stored in the database. The
+// event is recorded at the timestamp crdb reported, or at the time it was
+// received if that is missing or not RFC 3339, and req is updated to match.
+// Timestamps are kept in UTC, since the stores compare and bucket them as
+// RFC 3339 strings.
+func newFingerprintEvent(req *pb.Fingerprint) fingerprintEvent {
+	timestamp, err := time.Parse(time.RFC3339, req.GetTimestamp())
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		timestamp = time.Now()
 	}
-	defer db.Close()
+	timestamp = timestamp.UTC()
+	req.Timestamp = timestamp.Format(time.RFC3339Nano)
+	return fingerprintEvent{
+		fingerprintID: req.GetFingerprintId(),
+		input:         req.GetInput(),
+		timestamp:     timestamp,
+		latency:       time.Duration(req.GetLatencyNanos()),
+	}
+}
 
-	// Start gRPC server
-	go func() {
-		lis, err := net.Listen("tcp", ":50051")
-		if err != nil {
-			log.Fatalf("Failed to listen: %v", err)
+// obsVersion is the version of this obs build. Bundles declare the obs
+// versions they work with in their metadata. Override it at build time with
+// -ldflags "-X main.obsVersion=...".
+var obsVersion = "1.0.0"
+
+// compatibleUIVersions is the range of UI bundle versions that work with the
+// API served by this build of obs. Bump it when the API changes in a way old
+// bundles cannot handle.
+const compatibleUIVersions = "~1.0"
+
+// defaultMemStoreCapacity is the size of the in-memory ring buffer when no
+// row limit is configured.
+const defaultMemStoreCapacity = 10000
+
+// openStore creates the Store selected by the -store flag.
+func openStore(kind, path string, maxRows int) (Store, error) {
+	switch kind {
+	case "sqlite":
+		return newSQLiteStore(path)
+	case "memory":
+		if maxRows <= 0 {
+			maxRows = defaultMemStoreCapacity
 		}
+		return newMemStore(maxRows), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q", kind)
+	}
+}
+
+func main() {
+	grpcAddr := flag.String("grpc-addr", ":50051", "address to serve the fingerprint ingestion gRPC API on")
+	httpAddr := flag.String("http-addr", ":8080", "address to serve the HTTP API and UI on")
+	storeKind := flag.String("store", "sqlite", "storage backend for fingerprints: sqlite or memory")
+	dbPath := flag.String("db", "./fingerprints.db", "path to the SQLite database when -store=sqlite")
+	var policy retentionPolicy
+	flag.DurationVar(&policy.maxAge, "retention-max-age", 0, "delete fingerprints older than this; 0 keeps them regardless of age")
+	flag.IntVar(&policy.maxRows, "retention-max-rows", 300, "maximum number of fingerprints to keep; 0 for no limit")
+	flag.Int64Var(&policy.maxBytes, "retention-max-db-size", 0, "delete the oldest fingerprints while the store uses more than this many bytes; 0 for no limit")
+	flag.DurationVar(&policy.statsMaxAge, "retention-stats-max-age", 7*24*time.Hour, "delete per-fingerprint statistics older than this, or than -retention-max-age if that is longer; 0 keeps them regardless of age")
+	flag.DurationVar(&policy.interval, "retention-interval", 10*time.Second, "how often the retention policy is enforced")
+	flag.IntVar(&policy.batchSize, "retention-batch-size", 1000, "maximum number of fingerprints deleted per statement when enforcing retention")
+	streamBuffer := flag.Int("stream-buffer", 256, "number of fingerprints buffered for each live stream subscriber before they are dropped")
+	flag.IntVar(&uihandler.KeepVersions, "bundle-keep", uihandler.KeepVersions, "number of installed UI bundles kept on disk for rollback")
+	flag.StringVar(&uihandler.BucketURL, "bucket-url", uihandler.BucketURL, "URL of the bucket server UI bundles are downloaded from")
+	bundleDir := flag.String("bundle-dir", "obsbundle", "directory UI bundles are installed in")
+	bundlePollInterval := flag.Duration("bundle-poll-interval", time.Minute, "how often to check the bucket server for a newer UI bundle; 0 only checks once at startup")
+	flag.StringVar(&uihandler.Channel, "bundle-channel", uihandler.Channel, "release channel to install UI bundles from")
+	var tlsFiles tlsconfig.Files
+	flag.StringVar(&tlsFiles.Cert, "tls-cert", "", "PEM certificate for the gRPC ingestion API; if empty, it is served without TLS")
+	flag.StringVar(&tlsFiles.Key, "tls-key", "", "PEM private key for -tls-cert")
+	flag.StringVar(&tlsFiles.CA, "tls-ca", "", "PEM CA bundle that client certificates are verified against")
+	requireClientCert := flag.Bool("tls-require-client-cert", false, "only accept gRPC clients presenting a certificate signed by -tls-ca")
+	tlsReloadInterval := flag.Duration("tls-reload-interval", 10*time.Second, "how often to check the TLS files for changes")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for in-flight requests to finish when shutting down")
+	bundlePublicKey := flag.String("bundle-public-key", "", "PEM-encoded ed25519 public key that UI bundles must be signed with; without it, bundles are not downloaded unless -bundle-allow-unsigned is set")
+	flag.BoolVar(&uihandler.AllowUnsigned, "bundle-allow-unsigned", false, "download UI bundles without a -bundle-public-key, checking them only against the bucket server's SHA-256 manifest; insecure, since a compromised bucket server can then serve any UI")
+	if err := config.Parse(flag.CommandLine, "OBS", os.Args[1:]); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	if err := config.ValidateAddr("grpc-addr", *grpcAddr); err != nil {
+		log.Fatal(err)
+	}
+	if err := config.ValidateAddr("http-addr", *httpAddr); err != nil {
+		log.Fatal(err)
+	}
+	if err := config.ValidateURL("bucket-url", uihandler.BucketURL); err != nil {
+		log.Fatal(err)
+	}
+	if policy.interval <= 0 || policy.batchSize <= 0 {
+		log.Fatalf("-retention-interval and -retention-batch-size must be positive")
+	}
+	if *shutdownTimeout <= 0 {
+		log.Fatalf("-shutdown-timeout must be positive")
+	}
+	if *streamBuffer < 0 {
+		log.Fatalf("-stream-buffer must not be negative")
+	}
 
-		s := grpc.NewServer()
-		pb.RegisterCRDBServiceServer(s, &server{db: db})
-		log.Println("gRPC server is running on port :50051")
-		if err := s.Serve(lis); err != nil {
-			log.Fatalf("Failed to serve: %v", err)
+	if *bundlePublicKey != "" {
+		publicKey, err := uihandler.LoadPublicKey(*bundlePublicKey)
+		if err != nil {
+			log.Fatalf("Failed to load bundle public key: %v", err)
 		}
-	}()
+		uihandler.PublicKey = publicKey
+	} else if uihandler.AllowUnsigned {
+		log.Println("No bundle public key is set, installing unsigned UI bundles from the bucket server")
+	} else {
+		log.Println("No bundle public key is set, so UI bundles will not be downloaded from the bucket server; set -bundle-public-key, or -bundle-allow-unsigned to install them unverified")
+	}
 
-	s := &server{db: db}
+	grpcOptions, tlsReloader, err := grpcServerOptions(tlsFiles, *requireClientCert)
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+	if *tlsReloadInterval <= 0 {
+		log.Fatalf("-tls-reload-interval must be positive")
+	}
+
+	store, err := openStore(*storeKind, *dbPath, policy.maxRows)
+	if err != nil {
+		log.Fatalf("Failed to initialize store: %v", err)
+	}
+
+	// Listen before starting anything, so that a port in use fails fast.
+	grpcListener, err := net.Listen("tcp", *grpcAddr)
+	if err != nil {
+		store.Close()
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	httpListener, err := net.Listen("tcp", *httpAddr)
+	if err != nil {
+		store.Close()
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	l := newLifecycle()
+	l.onClose("store", store.Close)
+
+	retainer := newRetainer(store, policy)
+	l.goWorker(retainer.run)
+
+	broker := newBroker(*streamBuffer)
+
+	// Start gRPC server
+	grpcServer := grpc.NewServer(grpcOptions...)
+	if tlsReloader != nil {
+		l.goWorker(func(ctx context.Context) {
+			tlsReloader.Watch(ctx, *tlsReloadInterval)
+		})
+	}
+	pb.RegisterCRDBServiceServer(grpcServer, &server{store: store, retainer: retainer, broker: broker})
+	l.serve("gRPC", func() error {
+		log.Printf("gRPC server is running on %s", grpcListener.Addr())
+		return grpcServer.Serve(grpcListener)
+	}, func(ctx context.Context) error {
+		return stopGRPCServer(ctx, grpcServer)
+	})
+
+	bundles := uihandler.NewWatcher(compatibleUIVersions, *bundlePollInterval)
+	s := &server{store: store, retainer: retainer, broker: broker, bundles: bundles}
 	r := mux.NewRouter()
 
-	// Add CORS middleware
+	// Add CORS middleware. Only reads are allowed from any origin; the
+	// routes that change state check the origin themselves.
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"}, // Allow all origins
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedMethods: []string{"GET", "HEAD"},
 		AllowedHeaders: []string{"Content-Type", "Authorization"},
 	})
 
-	apiRouter := r.PathPrefix("/api").Subrouter()
-	apiRouter.HandleFunc("/fingerprints", s.listFingerprints).Methods("GET")
-	apiRouter.HandleFunc("/fingerprints/count", s.listFingerprintCounts).Methods("GET")
-	apiRouter.HandleFunc("/health", s.health).Methods("GET")
+	s.registerAPI(r)
 
 	// Serve the latest UI bundle
-	uihandler.Serve("v1.0", r)
+	uihandler.ObsVersion = obsVersion
+	uihandler.SetBundleDir(*bundleDir)
+	uihandler.Serve(compatibleUIVersions, r)
+	l.goWorker(bundles.Run)
 
-	handler := c.Handler(r)
+	httpServer := &http.Server{
+		Handler: c.Handler(r),
+		// Requests share the lifecycle's context, so live streams end as
+		// soon as shutdown starts instead of holding it up.
+		BaseContext: func(net.Listener) context.Context { return l.ctx },
+	}
+	l.serve("HTTP", func() error {
+		log.Printf("HTTP server is running on %s", httpListener.Addr())
+		if err := httpServer.Serve(httpListener); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	}, func(ctx context.Context) error {
+		return stopHTTPServer(ctx, httpServer)
+	})
 
-	log.Println("HTTP server is running on port :8080")
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	if err := l.wait(*shutdownTimeout); err != nil {
+		log.Fatalf("obs stopped: %v", err)
+	}
+	log.Println("obs stopped")
+}
+
+// grpcServerOptions configures TLS for the gRPC ingestion API. Without a
+// certificate it is served in plaintext, as before TLS was supported.
+func grpcServerOptions(files tlsconfig.Files, requireClientCert bool) ([]grpc.ServerOption, *tlsconfig.Reloader, error) {
+	if files.Cert == "" && files.Key == "" {
+		if files.CA != "" || requireClientCert {
+			return nil, nil, fmt.Errorf("-tls-ca and -tls-require-client-cert need -tls-cert and -tls-key")
+		}
+		log.Println("No TLS certificate is configured, serving gRPC without TLS")
+		return nil, nil, nil
+	}
+
+	reloader, err := tlsconfig.NewReloader(files)
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := reloader.ServerConfig(requireClientCert)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(config))}, reloader, nil
+}
+
+// stopHTTPServer stops s after in-flight requests finish, or closes every
+// connection if ctx expires first. Handlers may then still be running, so an
+// error is returned.
+func stopHTTPServer(ctx context.Context, s *http.Server) error {
+	err := s.Shutdown(ctx)
+	if err != nil {
+		s.Close()
+	}
+	return err
+}
+
+// stopGRPCServer stops s after in-flight RPCs finish, or cancels them if ctx
+// expires first.
+func stopGRPCServer(ctx context.Context, s *grpc.Server) error {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	}
 }
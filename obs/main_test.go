@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/lassenordahl/disaggui/obs/proto"
+)
+
+func TestNewFingerprintEvent(t *testing.T) {
+	reported := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+
+	tests := []struct {
+		name      string
+		timestamp string
+		want      time.Time
+	}{
+		{"utc", "2024-05-01T12:00:00.123456789Z", reported},
+		{"offset", "2024-05-01T14:00:00.123456789+02:00", reported},
+		{"seconds", "2024-05-01T12:00:00Z", reported.Truncate(time.Second)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &pb.Fingerprint{Timestamp: tt.timestamp}
+			event := newFingerprintEvent(req)
+			if !event.timestamp.Equal(tt.want) || event.timestamp.Location() != time.UTC {
+				t.Errorf("got timestamp %s, want %s", event.timestamp, tt.want)
+			}
+			if got, err := time.Parse(time.RFC3339, req.Timestamp); err != nil || !got.Equal(tt.want) {
+				t.Errorf("request timestamp is %q, want %s", req.Timestamp, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFingerprintEventFallback(t *testing.T) {
+	for _, timestamp := range []string{
+		"",
+		"2024-05-01 12:00:00",
+		"2024-05-01 12:00:00.123 +0000 UTC",
+		"UTC",
+	} {
+		t.Run(timestamp, func(t *testing.T) {
+			before := time.Now()
+			req := &pb.Fingerprint{Timestamp: timestamp}
+			event := newFingerprintEvent(req)
+			if event.timestamp.Before(before) || event.timestamp.After(time.Now()) {
+				t.Errorf("got timestamp %s, want the time it was received", event.timestamp)
+			}
+			if _, err := time.Parse(time.RFC3339, req.Timestamp); err != nil {
+				t.Errorf("request timestamp %q is not RFC 3339", req.Timestamp)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memStore is a Store that keeps the most recent fingerprint events in a
+// fixed-size ring buffer. Nothing survives a restart, which makes it suitable
+// for tests and ephemeral deployments.
+type memStore struct {
+	mu sync.RWMutex
+	// events is a ring buffer; next is the slot the next event is written
+	// to and size is the number of slots in use.
+	events []memEvent
+	next   int
+	size   int
+	// lastID is the sequence number of the most recently stored event,
+	// which plays the role of SQLite's row ID in cursors.
+	lastID int64
+	stats  map[uint64]*memFingerprintStats
+}
+
+type memEvent struct {
+	id int64
+	fingerprintEvent
+}
+
+type memFingerprintStats struct {
+	input string
+	// buckets is kept in chronological order.
+	buckets []StatsBucket
+}
+
+func newMemStore(capacity int) *memStore {
+	return &memStore{
+		events: make([]memEvent, capacity),
+		stats:  make(map[uint64]*memFingerprintStats),
+	}
+}
+
+func (m *memStore) Close() error {
+	return nil
+}
+
+func (m *memStore) StoreFingerprints(events []fingerprintEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, event := range events {
+		m.lastID++
+		m.events[m.next] = memEvent{id: m.lastID, fingerprintEvent: event}
+		m.next = (m.next + 1) % len(m.events)
+		m.size = min(m.size+1, len(m.events))
+
+		m.recordStats(event)
+	}
+	return nil
+}
+
+func (m *memStore) recordStats(event fingerprintEvent) {
+	fs, ok := m.stats[event.fingerprintID]
+	if !ok {
+		fs = &memFingerprintStats{input: event.input}
+		m.stats[event.fingerprintID] = fs
+	}
+
+	ts := event.timestamp.Format(time.RFC3339)
+	bucketStart := event.timestamp.Truncate(statsBucketInterval).Format(time.RFC3339)
+	nanos := event.latency.Nanoseconds()
+
+	// Events almost always land in the latest bucket, so search backwards.
+	for i := len(fs.buckets) - 1; i >= 0; i-- {
+		b := &fs.buckets[i]
+		if b.BucketStart != bucketStart {
+			continue
+		}
+		b.ExecutionCount++
+		b.FirstSeen = min(b.FirstSeen, ts)
+		b.LastSeen = max(b.LastSeen, ts)
+		b.LatencySumNanos += nanos
+		b.LatencyMinNanos = min(b.LatencyMinNanos, nanos)
+		b.LatencyMaxNanos = max(b.LatencyMaxNanos, nanos)
+		return
+	}
+
+	fs.buckets = append(fs.buckets, StatsBucket{
+		BucketStart:     bucketStart,
+		ExecutionCount:  1,
+		FirstSeen:       ts,
+		LastSeen:        ts,
+		LatencySumNanos: nanos,
+		LatencyMinNanos: nanos,
+		LatencyMaxNanos: nanos,
+	})
+	sort.SliceStable(fs.buckets, func(i, j int) bool {
+		return fs.buckets[i].BucketStart < fs.buckets[j].BucketStart
+	})
+}
+
+// newestFirst calls fn for each buffered event from the most to the least
+// recently stored, stopping early if fn returns false. m.mu must be held.
+func (m *memStore) newestFirst(fn func(memEvent) bool) {
+	for i := 1; i <= m.size; i++ {
+		idx := (m.next - i + len(m.events)) % len(m.events)
+		if !fn(m.events[idx]) {
+			return
+		}
+	}
+}
+
+func (e memEvent) cursor() fingerprintCursor {
+	return fingerprintCursor{unixTime: e.timestamp.Unix(), id: e.id}
+}
+
+// less orders cursors by (timestamp, id).
+func (c fingerprintCursor) less(other fingerprintCursor) bool {
+	if c.unixTime != other.unixTime {
+		return c.unixTime < other.unixTime
+	}
+	return c.id < other.id
+}
+
+func (m *memStore) QueryFingerprints(q fingerprintsQuery) (FingerprintPage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// inOrder reports whether a comes before b in the requested order.
+	inOrder := func(a, b fingerprintCursor) bool {
+		if q.ascending {
+			return a.less(b)
+		}
+		return b.less(a)
+	}
+
+	// Events are buffered in arrival order rather than timestamp order, so
+	// every match is collected and sorted.
+	var matched []memEvent
+	m.newestFirst(func(event memEvent) bool {
+		if q.matches(event.fingerprintEvent) && (q.after == nil || inOrder(*q.after, event.cursor())) {
+			matched = append(matched, event)
+		}
+		return true
+	})
+	sort.Slice(matched, func(i, j int) bool {
+		return inOrder(matched[i].cursor(), matched[j].cursor())
+	})
+
+	page := FingerprintPage{Fingerprints: []Fingerprint{}}
+	if len(matched) > q.limit {
+		matched = matched[:q.limit]
+		page.NextCursor = matched[q.limit-1].cursor().String()
+	}
+	for _, event := range matched {
+		page.Fingerprints = append(page.Fingerprints, event.fingerprint())
+	}
+	return page, nil
+}
+
+func (m *memStore) IntervalCounts(q intervalCountsQuery) ([]IntervalCount, error) {
+	first, end, step := q.bucketRange()
+
+	var wanted map[uint64]bool
+	if len(q.fingerprintIDs) > 0 {
+		wanted = make(map[uint64]bool, len(q.fingerprintIDs))
+		for _, id := range q.fingerprintIDs {
+			wanted[id] = true
+		}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	countsByBucket := make(map[int64]int)
+	m.newestFirst(func(event memEvent) bool {
+		ts := event.timestamp.Unix()
+		if ts >= first && ts < end && (wanted == nil || wanted[event.fingerprintID]) {
+			countsByBucket[ts/step*step]++
+		}
+		return true
+	})
+	return zeroFilledCounts(q, countsByBucket), nil
+}
+
+func (m *memStore) FingerprintStats(fingerprintID uint64) (FingerprintStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	fs, ok := m.stats[fingerprintID]
+	if !ok {
+		return FingerprintStats{}, errFingerprintNotFound
+	}
+
+	// The buckets are copied so that the response does not race with later
+	// writes.
+	buckets := append([]StatsBucket(nil), fs.buckets...)
+	return newFingerprintStats(fingerprintID, fs.input, buckets), nil
+}
+
+func (m *memStore) CountFingerprints() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size, nil
+}
+
+// memEventOverhead approximates the bytes used by an event besides its input.
+const memEventOverhead = 64
+
+// SizeBytes estimates the memory held by buffered events.
+func (m *memStore) SizeBytes() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var size int64
+	m.newestFirst(func(event memEvent) bool {
+		size += int64(len(event.input)) + memEventOverhead
+		return true
+	})
+	return size, nil
+}
+
+// deleteOldestWhile drops events from the tail of the ring for as long as
+// keep returns true, up to limit events. m.mu must be held.
+func (m *memStore) deleteOldestWhile(limit int, keep func(fingerprintEvent) bool) int {
+	deleted := 0
+	for deleted < limit && m.size > 0 {
+		oldest := (m.next - m.size + len(m.events)) % len(m.events)
+		if !keep(m.events[oldest].fingerprintEvent) {
+			break
+		}
+		m.events[oldest] = memEvent{}
+		m.size--
+		deleted++
+	}
+	return deleted
+}
+
+func (m *memStore) DeleteFingerprintsBefore(cutoff time.Time, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deleteOldestWhile(limit, func(event fingerprintEvent) bool {
+		return event.timestamp.Before(cutoff)
+	}), nil
+}
+
+func (m *memStore) DeleteOldestFingerprints(n int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deleteOldestWhile(n, func(fingerprintEvent) bool { return true }), nil
+}
+
+func (m *memStore) DeleteStatsBefore(cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A bucket ends statsBucketInterval after it starts.
+	threshold := cutoff.Add(-statsBucketInterval).Format(time.RFC3339)
+	deleted := 0
+	for id, fs := range m.stats {
+		kept := fs.buckets[:0]
+		for _, b := range fs.buckets {
+			if b.BucketStart < threshold {
+				deleted++
+				continue
+			}
+			kept = append(kept, b)
+		}
+		fs.buckets = kept
+		if len(fs.buckets) == 0 {
+			delete(m.stats, id)
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is a single, ordered change to the SQLite schema. Migrations are
+// applied once each, in order of version, and must never be edited after
+// they have shipped; add a new one instead.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in order. The first migrations are
+// written to tolerate databases created before the migration framework
+// existed, which have the tables but no recorded version.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create fingerprints table",
+		up: execStatements(
+			"CREATE TABLE IF NOT EXISTS fingerprints (id INTEGER PRIMARY KEY AUTOINCREMENT, input TEXT, timestamp TEXT)",
+		),
+	},
+	{
+		version:     2,
+		description: "add fingerprint IDs",
+		up: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "fingerprints", "fingerprint_id", "INTEGER"); err != nil {
+				return err
+			}
+			return execStatements(
+				"CREATE INDEX IF NOT EXISTS fingerprints_fingerprint_id ON fingerprints (fingerprint_id)",
+			)(tx)
+		},
+	},
+	{
+		version:     3,
+		description: "create fingerprint stats table",
+		up: execStatements(`CREATE TABLE IF NOT EXISTS fingerprint_stats (
+			fingerprint_id INTEGER NOT NULL,
+			bucket_start TEXT NOT NULL,
+			input TEXT,
+			execution_count INTEGER NOT NULL,
+			first_seen TEXT NOT NULL,
+			last_seen TEXT NOT NULL,
+			latency_sum_nanos INTEGER NOT NULL,
+			latency_min_nanos INTEGER NOT NULL,
+			latency_max_nanos INTEGER NOT NULL,
+			PRIMARY KEY (fingerprint_id, bucket_start)
+		)`),
+	},
+	{
+		version:     4,
+		description: "add Unix timestamps for keyset pagination",
+		up: execStatements(
+			"ALTER TABLE fingerprints ADD COLUMN unix_time INTEGER",
+			"UPDATE fingerprints SET unix_time = CAST(strftime('%s', timestamp) AS INTEGER)",
+			"CREATE INDEX fingerprints_unix_time_id ON fingerprints (unix_time, id)",
+		),
+	},
+}
+
+func execStatements(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrate brings the database schema up to the latest version. It refuses to
+// touch a database whose schema is newer than this binary knows about.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, description TEXT, applied_at TEXT)")
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %v", err)
+	}
+
+	var current int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than the latest version %d supported by this binary", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("failed to apply migration %d (%s): %v", m.version, m.description, err)
+		}
+		log.Printf("Applied migration %d: %s", m.version, m.description)
+	}
+	return nil
+}
+
+// applyMigration runs m and records it in a single transaction, so a failed
+// migration leaves the schema at the previous version.
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)",
+		m.version, m.description, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func addColumnIfMissing(tx *sql.Tx, table, column, columnType string) error {
+	exists, err := hasColumn(tx, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, columnType))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s: %v", column, err)
+	}
+	return nil
+}
+
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("failed to query table info: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return false, fmt.Errorf("failed to scan table info: %v", err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("failed to read table info: %v", err)
+	}
+	return false, nil
+}
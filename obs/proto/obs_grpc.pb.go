@@ -20,6 +20,7 @@ const _ = grpc.SupportPackageIsVersion8
 
 const (
 	CRDBService_ProcessFingerprint_FullMethodName = "/obs.CRDBService/ProcessFingerprint"
+	CRDBService_StreamFingerprints_FullMethodName = "/obs.CRDBService/StreamFingerprints"
 )
 
 // CRDBServiceClient is the client API for CRDBService service.
@@ -27,6 +28,7 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type CRDBServiceClient interface {
 	ProcessFingerprint(ctx context.Context, in *Fingerprint, opts ...grpc.CallOption) (*Ack, error)
+	StreamFingerprints(ctx context.Context, opts ...grpc.CallOption) (CRDBService_StreamFingerprintsClient, error)
 }
 
 type cRDBServiceClient struct {
@@ -47,11 +49,47 @@ func (c *cRDBServiceClient) ProcessFingerprint(ctx context.Context, in *Fingerpr
 	return out, nil
 }
 
+func (c *cRDBServiceClient) StreamFingerprints(ctx context.Context, opts ...grpc.CallOption) (CRDBService_StreamFingerprintsClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &CRDBService_ServiceDesc.Streams[0], CRDBService_StreamFingerprints_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &cRDBServiceStreamFingerprintsClient{ClientStream: stream}
+	return x, nil
+}
+
+type CRDBService_StreamFingerprintsClient interface {
+	Send(*Fingerprint) error
+	CloseAndRecv() (*Ack, error)
+	grpc.ClientStream
+}
+
+type cRDBServiceStreamFingerprintsClient struct {
+	grpc.ClientStream
+}
+
+func (x *cRDBServiceStreamFingerprintsClient) Send(m *Fingerprint) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *cRDBServiceStreamFingerprintsClient) CloseAndRecv() (*Ack, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(Ack)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // CRDBServiceServer is the server API for CRDBService service.
 // All implementations must embed UnimplementedCRDBServiceServer
 // for forward compatibility
 type CRDBServiceServer interface {
 	ProcessFingerprint(context.Context, *Fingerprint) (*Ack, error)
+	StreamFingerprints(CRDBService_StreamFingerprintsServer) error
 	mustEmbedUnimplementedCRDBServiceServer()
 }
 
@@ -62,6 +100,9 @@ type UnimplementedCRDBServiceServer struct {
 func (UnimplementedCRDBServiceServer) ProcessFingerprint(context.Context, *Fingerprint) (*Ack, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ProcessFingerprint not implemented")
 }
+func (UnimplementedCRDBServiceServer) StreamFingerprints(CRDBService_StreamFingerprintsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamFingerprints not implemented")
+}
 func (UnimplementedCRDBServiceServer) mustEmbedUnimplementedCRDBServiceServer() {}
 
 // UnsafeCRDBServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -93,6 +134,32 @@ func _CRDBService_ProcessFingerprint_Handler(srv interface{}, ctx context.Contex
 	return interceptor(ctx, in, info, handler)
 }
 
+func _CRDBService_StreamFingerprints_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CRDBServiceServer).StreamFingerprints(&cRDBServiceStreamFingerprintsServer{ServerStream: stream})
+}
+
+type CRDBService_StreamFingerprintsServer interface {
+	SendAndClose(*Ack) error
+	Recv() (*Fingerprint, error)
+	grpc.ServerStream
+}
+
+type cRDBServiceStreamFingerprintsServer struct {
+	grpc.ServerStream
+}
+
+func (x *cRDBServiceStreamFingerprintsServer) SendAndClose(m *Ack) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *cRDBServiceStreamFingerprintsServer) Recv() (*Fingerprint, error) {
+	m := new(Fingerprint)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // CRDBService_ServiceDesc is the grpc.ServiceDesc for CRDBService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -105,6 +172,12 @@ var CRDBService_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _CRDBService_ProcessFingerprint_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamFingerprints",
+			Handler:       _CRDBService_StreamFingerprints_Handler,
+			ClientStreams: true,
+		},
+	},
 	Metadata: "obs/proto/obs.proto",
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// retentionPolicy bounds how much fingerprint history a Store keeps. A zero
+// limit disables that check.
+type retentionPolicy struct {
+	maxAge    time.Duration
+	maxRows   int
+	maxBytes  int64
+	interval  time.Duration
+	batchSize int
+
+	// statsMaxAge is how long statistics buckets are kept. The row and size
+	// limits only bound the events, so stats need a window of their own;
+	// they are never pruned before maxAge.
+	statsMaxAge time.Duration
+}
+
+// RetentionStats reports what the retention worker has pruned since obs
+// started.
+type RetentionStats struct {
+	MaxAge            string `json:"max_age"`
+	MaxRows           int    `json:"max_rows"`
+	MaxBytes          int64  `json:"max_bytes"`
+	StatsMaxAge       string `json:"stats_max_age"`
+	Runs              int64  `json:"runs"`
+	RowsPruned        int64  `json:"rows_pruned"`
+	RowsPrunedByAge   int64  `json:"rows_pruned_by_age"`
+	RowsPrunedByCount int64  `json:"rows_pruned_by_count"`
+	RowsPrunedBySize  int64  `json:"rows_pruned_by_size"`
+	StatsPruned       int64  `json:"stats_buckets_pruned"`
+	LastRun           string `json:"last_run,omitempty"`
+	LastError         string `json:"last_error,omitempty"`
+}
+
+// retainer periodically prunes a Store down to its retention policy. Rows
+// are deleted in batches of policy.batchSize so that a large backlog does not
+// hold the database lock for long.
+type retainer struct {
+	store  Store
+	policy retentionPolicy
+
+	mu    sync.Mutex
+	stats RetentionStats
+}
+
+func newRetainer(store Store, policy retentionPolicy) *retainer {
+	return &retainer{
+		store:  store,
+		policy: policy,
+		stats: RetentionStats{
+			MaxAge:      policy.maxAge.String(),
+			MaxRows:     policy.maxRows,
+			MaxBytes:    policy.maxBytes,
+			StatsMaxAge: policy.statsMaxAge.String(),
+		},
+	}
+}
+
+// run enforces the policy every policy.interval until ctx is cancelled.
+func (r *retainer) run(ctx context.Context) {
+	ticker := time.NewTicker(r.policy.interval)
+	defer ticker.Stop()
+
+	for {
+		r.compact()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// compact runs a single pass of every configured limit.
+func (r *retainer) compact() {
+	var byAge, byCount, bySize, stats int
+	err := func() error {
+		var err error
+		if r.policy.maxAge > 0 {
+			cutoff := time.Now().Add(-r.policy.maxAge)
+			byAge, err = r.deleteInBatches(func() (int, error) {
+				return r.store.DeleteFingerprintsBefore(cutoff, r.policy.batchSize)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if r.policy.maxRows > 0 {
+			count, err := r.store.CountFingerprints()
+			if err != nil {
+				return err
+			}
+			excess := count - r.policy.maxRows
+			byCount, err = r.deleteInBatches(func() (int, error) {
+				if excess <= 0 {
+					return 0, nil
+				}
+				n, err := r.store.DeleteOldestFingerprints(min(excess, r.policy.batchSize))
+				excess -= n
+				return n, err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if r.policy.maxBytes > 0 {
+			bySize, err = r.deleteInBatches(func() (int, error) {
+				size, err := r.store.SizeBytes()
+				if err != nil || size <= r.policy.maxBytes {
+					return 0, err
+				}
+				return r.store.DeleteOldestFingerprints(r.policy.batchSize)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if r.policy.statsMaxAge > 0 {
+			cutoff := time.Now().Add(-max(r.policy.statsMaxAge, r.policy.maxAge))
+			stats, err = r.store.DeleteStatsBefore(cutoff)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Runs++
+	r.stats.RowsPrunedByAge += int64(byAge)
+	r.stats.RowsPrunedByCount += int64(byCount)
+	r.stats.RowsPrunedBySize += int64(bySize)
+	r.stats.RowsPruned += int64(byAge + byCount + bySize)
+	r.stats.StatsPruned += int64(stats)
+	r.stats.LastRun = time.Now().Format(time.RFC3339)
+	r.stats.LastError = ""
+	if err != nil {
+		r.stats.LastError = err.Error()
+		log.Printf("Retention failed: %v", err)
+	}
+	if pruned := byAge + byCount + bySize; pruned > 0 || stats > 0 {
+		log.Printf("Retention pruned %d fingerprints (%d by age, %d by count, %d by size) and %d stats buckets",
+			pruned, byAge, byCount, bySize, stats)
+	}
+}
+
+// deleteInBatches calls deleteBatch until it deletes nothing and returns the
+// total number of rows deleted.
+func (r *retainer) deleteInBatches(deleteBatch func() (int, error)) (int, error) {
+	total := 0
+	for {
+		n, err := deleteBatch()
+		total += n
+		if err != nil || n == 0 {
+			return total, err
+		}
+	}
+}
+
+func (r *retainer) Stats() RetentionStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
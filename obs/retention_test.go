@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionPrunesStatsUnderRowLimit(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		store := open(t)
+		now := time.Now().UTC()
+		err := store.StoreFingerprints([]fingerprintEvent{
+			{fingerprintID: 1, input: "SELECT _", timestamp: now.Add(-3 * time.Hour)},
+			{fingerprintID: 2, input: "SELECT _, _", timestamp: now},
+		})
+		if err != nil {
+			t.Fatalf("failed to store fingerprints: %v", err)
+		}
+
+		// Only the row limit and the stats window are set, so the stats of
+		// the evicted fingerprint must still age out.
+		r := newRetainer(store, retentionPolicy{maxRows: 1, statsMaxAge: time.Hour, batchSize: 10})
+		r.compact()
+
+		stats := r.Stats()
+		if stats.LastError != "" || stats.RowsPrunedByCount != 1 || stats.StatsPruned != 1 {
+			t.Errorf("got %+v, want one row pruned by count and one stats bucket pruned", stats)
+		}
+		if _, err := store.FingerprintStats(1); err != errFingerprintNotFound {
+			t.Errorf("FingerprintStats(1) returned %v, want errFingerprintNotFound", err)
+		}
+		if _, err := store.FingerprintStats(2); err != nil {
+			t.Errorf("FingerprintStats(2) failed: %v", err)
+		}
+	})
+}
+
+func TestRetentionKeepsStatsForMaxAge(t *testing.T) {
+	store := newMemStore(100)
+	now := time.Now().UTC()
+	if err := store.StoreFingerprints([]fingerprintEvent{{fingerprintID: 1, input: "SELECT _", timestamp: now.Add(-3 * time.Hour)}}); err != nil {
+		t.Fatalf("failed to store fingerprint: %v", err)
+	}
+
+	// Stats are not pruned before the events they were computed from.
+	r := newRetainer(store, retentionPolicy{maxAge: 24 * time.Hour, statsMaxAge: time.Hour, batchSize: 10})
+	r.compact()
+	if _, err := store.FingerprintStats(1); err != nil {
+		t.Errorf("FingerprintStats failed: %v", err)
+	}
+	if stats := r.Stats(); stats.StatsPruned != 0 {
+		t.Errorf("pruned %d stats buckets, want none", stats.StatsPruned)
+	}
+}
@@ -0,0 +1,401 @@
+// Package semver parses semantic versions (https://semver.org) and resolves
+// them against npm-style range constraints such as "~1.0", "^1" or
+// ">=1.0.2 <1.1".
+package semver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed semantic version. Build metadata is kept for display but
+// ignored when comparing versions.
+type Version struct {
+	Major, Minor, Patch uint64
+	// Prerelease holds the dot-separated pre-release identifiers, if any.
+	Prerelease []string
+	Build      string
+}
+
+// Parse parses a version of the form MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD],
+// optionally prefixed with "v".
+func Parse(s string) (Version, error) {
+	p, err := parsePartial(s)
+	if err != nil {
+		return Version{}, err
+	}
+	if p.parts < 3 {
+		return Version{}, fmt.Errorf("invalid version %q: expected MAJOR.MINOR.PATCH", s)
+	}
+	return p.Version, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) > 0 {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 depending on whether v has lower, equal or
+// higher precedence than other.
+func (v Version) Compare(other Version) int {
+	if c := compareUint(v.Major, other.Major); c != 0 {
+		return c
+	}
+	if c := compareUint(v.Minor, other.Minor); c != 0 {
+		return c
+	}
+	if c := compareUint(v.Patch, other.Patch); c != 0 {
+		return c
+	}
+
+	// A pre-release has lower precedence than the release itself.
+	switch {
+	case len(v.Prerelease) == 0 && len(other.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(other.Prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Prerelease) && i < len(other.Prerelease); i++ {
+		if c := comparePrereleaseIdentifier(v.Prerelease[i], other.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(v.Prerelease)), uint64(len(other.Prerelease)))
+}
+
+// LessThan reports whether v has lower precedence than other.
+func (v Version) LessThan(other Version) bool {
+	return v.Compare(other) < 0
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// comparePrereleaseIdentifier compares numeric identifiers numerically and
+// others lexically, with numeric identifiers ranking lower.
+func comparePrereleaseIdentifier(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareUint(an, bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// partial is a version that may omit its minor and patch numbers, or replace
+// them with a wildcard, as allowed in constraints. parts is the number of
+// numbers given.
+type partial struct {
+	Version
+	parts int
+}
+
+func parsePartial(s string) (partial, error) {
+	var p partial
+	rest := strings.TrimPrefix(s, "v")
+	if rest == "" {
+		return p, fmt.Errorf("invalid version %q", s)
+	}
+
+	if i := strings.IndexByte(rest, '+'); i >= 0 {
+		p.Build = rest[i+1:]
+		if !validIdentifiers(p.Build, false) {
+			return p, fmt.Errorf("invalid build metadata in version %q", s)
+		}
+		rest = rest[:i]
+	}
+	if i := strings.IndexByte(rest, '-'); i >= 0 {
+		if !validIdentifiers(rest[i+1:], true) {
+			return p, fmt.Errorf("invalid pre-release in version %q", s)
+		}
+		p.Prerelease = strings.Split(rest[i+1:], ".")
+		rest = rest[:i]
+	}
+
+	numbers := strings.Split(rest, ".")
+	if len(numbers) > 3 {
+		return p, fmt.Errorf("invalid version %q", s)
+	}
+	fields := []*uint64{&p.Major, &p.Minor, &p.Patch}
+	for i, n := range numbers {
+		if n == "x" || n == "X" || n == "*" {
+			// Everything after a wildcard is a wildcard too.
+			break
+		}
+		if n == "" || (len(n) > 1 && n[0] == '0') {
+			return p, fmt.Errorf("invalid number %q in version %q", n, s)
+		}
+		value, err := strconv.ParseUint(n, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid number %q in version %q", n, s)
+		}
+		*fields[i] = value
+		p.parts++
+	}
+	if p.parts < 3 && (len(p.Prerelease) > 0 || p.Build != "") {
+		return p, fmt.Errorf("invalid version %q: a pre-release requires MAJOR.MINOR.PATCH", s)
+	}
+	return p, nil
+}
+
+// validIdentifiers reports whether s is a non-empty, dot-separated list of
+// alphanumeric identifiers. Numeric pre-release identifiers may not have
+// leading zeros.
+func validIdentifiers(s string, prerelease bool) bool {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return false
+		}
+		numeric := true
+		for _, c := range id {
+			switch {
+			case c >= '0' && c <= '9':
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '-':
+				numeric = false
+			default:
+				return false
+			}
+		}
+		if prerelease && numeric && len(id) > 1 && id[0] == '0' {
+			return false
+		}
+	}
+	return true
+}
+
+// Constraint is a set of version ranges. A version satisfies the constraint
+// if it satisfies every comparator of any one range.
+//
+// Ranges are separated by "||" and comparators within a range by spaces. A
+// comparator is a version preceded by one of =, <, <=, > or >=, optionally
+// followed by a space, or one of these shorthands:
+//
+//	1.2 or 1.2.x    >=1.2.0 <1.3.0
+//	*               any version
+//	~1.2.3          >=1.2.3 <1.3.0
+//	~1.2            >=1.2.0 <1.3.0
+//	~1              >=1.0.0 <2.0.0
+//	^1.2.3          >=1.2.3 <2.0.0
+//	^0.2.3          >=0.2.3 <0.3.0
+//	^0.0.3          >=0.0.3 <0.0.4
+//	1.0.0 - 1.2.0   >=1.0.0 <=1.2.0
+//
+// As in npm, a pre-release version only satisfies a range if one of the
+// range's comparators names a pre-release of the same MAJOR.MINOR.PATCH, so
+// that "^1.0" never selects 1.3.0-beta.1.
+type Constraint struct {
+	raw    string
+	ranges [][]comparator
+}
+
+type comparator struct {
+	op      string
+	version Version
+}
+
+// ParseConstraint parses a constraint in the syntax described on Constraint.
+func ParseConstraint(s string) (Constraint, error) {
+	c := Constraint{raw: s}
+	for _, r := range strings.Split(s, "||") {
+		comparators, err := parseRange(r)
+		if err != nil {
+			return Constraint{}, fmt.Errorf("invalid constraint %q: %v", s, err)
+		}
+		c.ranges = append(c.ranges, comparators)
+	}
+	return c, nil
+}
+
+func (c Constraint) String() string {
+	return c.raw
+}
+
+func parseRange(s string) ([]comparator, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 3 && fields[1] == "-" {
+		lower, err := parsePartial(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		upper, err := parsePartial(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		return append(expand(">=", lower), expand("<=", upper)...), nil
+	}
+
+	if len(fields) == 0 {
+		// An empty range matches any version, like "*".
+		return nil, nil
+	}
+	var comparators []comparator
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		op := ""
+		for _, prefix := range []string{">=", "<=", ">", "<", "=", "~", "^"} {
+			if strings.HasPrefix(f, prefix) {
+				op = prefix
+				break
+			}
+		}
+		if f == op {
+			// The version may be separated from its operator, as in
+			// ">= 1.0".
+			if i+1 == len(fields) {
+				return nil, fmt.Errorf("missing version after %s", op)
+			}
+			i++
+			f += fields[i]
+		}
+		p, err := parsePartial(strings.TrimPrefix(f, op))
+		if err != nil {
+			return nil, err
+		}
+		comparators = append(comparators, expand(op, p)...)
+	}
+	return comparators, nil
+}
+
+// expand rewrites a comparator on a partial version as comparators on full
+// versions.
+func expand(op string, p partial) []comparator {
+	v := p.Version
+	// next returns the first version after every version matching the
+	// first n numbers of v.
+	next := func(n int) Version {
+		switch n {
+		case 0:
+			return Version{}
+		case 1:
+			return Version{Major: v.Major + 1}
+		case 2:
+			return Version{Major: v.Major, Minor: v.Minor + 1}
+		}
+		return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+	}
+	between := func(lower, upper Version) []comparator {
+		return []comparator{{">=", lower}, {"<", upper}}
+	}
+
+	if p.parts == 0 {
+		// A wildcard matches any version.
+		return nil
+	}
+
+	switch op {
+	case "~":
+		if p.parts == 1 {
+			return between(v, next(1))
+		}
+		return between(v, next(2))
+	case "^":
+		// Allow changes that do not modify the left-most non-zero number.
+		switch {
+		case v.Major > 0 || p.parts == 1:
+			return between(v, next(1))
+		case v.Minor > 0 || p.parts == 2:
+			return between(v, next(2))
+		}
+		return between(v, next(3))
+	case ">":
+		if p.parts < 3 {
+			return []comparator{{">=", next(p.parts)}}
+		}
+	case "<=":
+		if p.parts < 3 {
+			return []comparator{{"<", next(p.parts)}}
+		}
+	case "", "=":
+		if p.parts < 3 {
+			return between(v, next(p.parts))
+		}
+		op = "="
+	}
+	return []comparator{{op, v}}
+}
+
+func (c comparator) check(v Version) bool {
+	cmp := v.Compare(c.version)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// Check reports whether v satisfies the constraint.
+func (c Constraint) Check(v Version) bool {
+	for _, r := range c.ranges {
+		if checkRange(r, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkRange(comparators []comparator, v Version) bool {
+	for _, c := range comparators {
+		if !c.check(v) {
+			return false
+		}
+	}
+	if len(v.Prerelease) == 0 {
+		return true
+	}
+	for _, c := range comparators {
+		cv := c.version
+		if len(cv.Prerelease) > 0 && cv.Major == v.Major && cv.Minor == v.Minor && cv.Patch == v.Patch {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxSatisfying returns the highest of versions that satisfies c, in the form
+// it was given. Strings that are not valid versions are skipped.
+func MaxSatisfying(versions []string, c Constraint) (string, bool) {
+	var (
+		best      string
+		bestValue Version
+		found     bool
+	)
+	for _, s := range versions {
+		v, err := Parse(s)
+		if err != nil || !c.Check(v) {
+			continue
+		}
+		if !found || bestValue.LessThan(v) {
+			best, bestValue, found = s, v, true
+		}
+	}
+	return best, found
+}
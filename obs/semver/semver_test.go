@@ -0,0 +1,198 @@
+package semver
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Version
+	}{
+		{"1.2.3", Version{Major: 1, Minor: 2, Patch: 3}},
+		{"v1.2.3", Version{Major: 1, Minor: 2, Patch: 3}},
+		{"0.0.0", Version{}},
+		{"1.0.10", Version{Major: 1, Patch: 10}},
+		{"1.0.0-beta.1", Version{Major: 1, Prerelease: []string{"beta", "1"}}},
+		{"1.0.0-x-y.0", Version{Major: 1, Prerelease: []string{"x-y", "0"}}},
+		{"1.0.0+build.5", Version{Major: 1, Build: "build.5"}},
+		{"1.0.0-rc.1+001", Version{Major: 1, Prerelease: []string{"rc", "1"}, Build: "001"}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got.String() != tt.want.String() {
+			t.Errorf("Parse(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"v",
+		"1",
+		"1.2",
+		"1.x",
+		"1.2.3.4",
+		"01.2.3",
+		"1.02.3",
+		"1.2.-3",
+		"a.b.c",
+		"1.2.3-",
+		"1.2.3-beta..1",
+		"1.2.3-01",
+		"1.2.3-beta_1",
+		"1.2.3+",
+		"1.2.3+build!",
+		" 1.2.3",
+	} {
+		if v, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) = %s, want an error", in, v)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// Each version has lower precedence than the next.
+	ordered := []string{
+		"0.0.1",
+		"0.1.0",
+		"0.9.0",
+		"0.10.0",
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.2",
+		"1.0.9",
+		"1.0.10",
+		"1.1.0",
+		"2.0.0",
+		"10.0.0",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			a, b := mustParse(t, ordered[i]), mustParse(t, ordered[j])
+			want := compareUint(uint64(i), uint64(j))
+			if got := a.Compare(b); got != want {
+				t.Errorf("Compare(%s, %s) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+
+	// Build metadata does not affect precedence.
+	if c := mustParse(t, "1.0.0+a").Compare(mustParse(t, "1.0.0+b")); c != 0 {
+		t.Errorf("Compare(1.0.0+a, 1.0.0+b) = %d, want 0", c)
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		matches    []string
+		excludes   []string
+	}{
+		{"1.2.3", []string{"1.2.3"}, []string{"1.2.4", "1.2.2"}},
+		{"=1.2.3", []string{"1.2.3"}, []string{"1.2.4"}},
+		{"1.2", []string{"1.2.0", "1.2.9"}, []string{"1.3.0", "1.1.9"}},
+		{"1.2.x", []string{"1.2.0", "1.2.9"}, []string{"1.3.0"}},
+		{"*", []string{"0.0.0", "9.9.9"}, []string{"1.0.0-beta"}},
+		{"", []string{"1.0.0"}, nil},
+		{"~1.2.3", []string{"1.2.3", "1.2.10"}, []string{"1.2.2", "1.3.0"}},
+		{"~1.2", []string{"1.2.0", "1.2.10"}, []string{"1.3.0", "1.1.0"}},
+		{"~1", []string{"1.0.0", "1.9.9"}, []string{"2.0.0", "0.9.0"}},
+		{"~1.0", []string{"1.0.0", "1.0.9", "1.0.10"}, []string{"1.1.0", "1.0.10-beta"}},
+		{"^1.2.3", []string{"1.2.3", "1.9.0"}, []string{"1.2.2", "2.0.0"}},
+		{"^1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0", "0.2.2"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4", "0.0.2"}},
+		{"^0.0", []string{"0.0.0", "0.0.9"}, []string{"0.1.0"}},
+		{"1.0.0 - 1.2.0", []string{"1.0.0", "1.1.5", "1.2.0"}, []string{"0.9.9", "1.2.1"}},
+		{"1.0 - 1.2", []string{"1.0.0", "1.2.9"}, []string{"1.3.0", "0.9.0"}},
+		{">=1.0.2 <1.1", []string{"1.0.2", "1.0.10"}, []string{"1.0.1", "1.1.0"}},
+		{">= 1.0", []string{"1.0.0", "2.0.0"}, []string{"0.9.9"}},
+		{">= 1.0.2 < 1.1", []string{"1.0.2"}, []string{"1.0.1", "1.1.0"}},
+		{">1.2", []string{"1.3.0"}, []string{"1.2.9"}},
+		{"<=1.2", []string{"1.2.9"}, []string{"1.3.0"}},
+		{"<1.2.0", []string{"1.1.9"}, []string{"1.2.0", "1.2.0-beta"}},
+		{"^1.0 || ^2.0", []string{"1.5.0", "2.5.0"}, []string{"3.0.0", "0.5.0"}},
+		// Pre-releases only match ranges naming a pre-release of the same
+		// version.
+		{"^1.0", []string{"1.3.0"}, []string{"1.3.0-beta.1"}},
+		{">=1.3.0-beta.1", []string{"1.3.0-beta.1", "1.3.0-beta.2", "1.3.0", "1.4.0"}, []string{"1.3.0-alpha", "1.4.0-beta"}},
+	}
+	for _, tt := range tests {
+		c, err := ParseConstraint(tt.constraint)
+		if err != nil {
+			t.Errorf("ParseConstraint(%q) failed: %v", tt.constraint, err)
+			continue
+		}
+		for _, v := range tt.matches {
+			if !c.Check(mustParse(t, v)) {
+				t.Errorf("%q does not match %s", tt.constraint, v)
+			}
+		}
+		for _, v := range tt.excludes {
+			if c.Check(mustParse(t, v)) {
+				t.Errorf("%q matches %s", tt.constraint, v)
+			}
+		}
+	}
+}
+
+func TestParseConstraintErrors(t *testing.T) {
+	for _, in := range []string{
+		"1.2.3.4",
+		"~v",
+		">=",
+		">=1.0 <",
+		"1.0 - ",
+		"^1.0 || y",
+		"1.2-beta",
+	} {
+		if _, err := ParseConstraint(in); err == nil {
+			t.Errorf("ParseConstraint(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestMaxSatisfying(t *testing.T) {
+	versions := []string{"v1.0.2", "v1.0.9", "v1.0.10", "v1.1.0-beta.1", "v1.1.0", "v2.0.0", "latest", "v1.0.11-rc.1"}
+
+	tests := []struct {
+		constraint string
+		want       string
+	}{
+		{"~1.0", "v1.0.10"},
+		{"^1", "v1.1.0"},
+		{"*", "v2.0.0"},
+		{">=1.1.0-beta.1 <1.1.0", "v1.1.0-beta.1"},
+		{"<1.0.9", "v1.0.2"},
+		{"^3", ""},
+	}
+	for _, tt := range tests {
+		c, err := ParseConstraint(tt.constraint)
+		if err != nil {
+			t.Fatalf("ParseConstraint(%q) failed: %v", tt.constraint, err)
+		}
+		got, ok := MaxSatisfying(versions, c)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("MaxSatisfying(%q) = %q, %v, want %q", tt.constraint, got, ok, tt.want)
+		}
+	}
+}
+
+func mustParse(t *testing.T, s string) Version {
+	t.Helper()
+	v, err := Parse(s)
+	if err != nil {
+		t.Fatalf("Parse(%q) failed: %v", s, err)
+	}
+	return v
+}
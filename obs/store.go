@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store persists the fingerprints reported by crdb and answers the queries
+// behind the HTTP API.
+type Store interface {
+	// StoreFingerprints records a batch of events atomically.
+	StoreFingerprints(events []fingerprintEvent) error
+	// QueryFingerprints returns a page of the fingerprints matching q,
+	// ordered by (timestamp, id).
+	QueryFingerprints(q fingerprintsQuery) (FingerprintPage, error)
+	// IntervalCounts counts fingerprints in consecutive buckets of q.interval
+	// covering [q.start, q.end). Bucket boundaries are aligned to multiples
+	// of the interval since the Unix epoch, and buckets without any
+	// fingerprints are included with a count of zero.
+	IntervalCounts(q intervalCountsQuery) ([]IntervalCount, error)
+	// FingerprintStats returns the aggregated statistics for a fingerprint,
+	// or errFingerprintNotFound if it has never been seen.
+	FingerprintStats(fingerprintID uint64) (FingerprintStats, error)
+
+	// CountFingerprints returns the number of stored fingerprint events.
+	CountFingerprints() (int, error)
+	// SizeBytes returns the space used by the stored data.
+	SizeBytes() (int64, error)
+	// DeleteFingerprintsBefore deletes up to limit of the oldest events
+	// recorded before cutoff and returns how many were deleted.
+	DeleteFingerprintsBefore(cutoff time.Time, limit int) (int, error)
+	// DeleteOldestFingerprints deletes up to n of the oldest events and
+	// returns how many were deleted.
+	DeleteOldestFingerprints(n int) (int, error)
+	// DeleteStatsBefore deletes the statistics buckets that ended before
+	// cutoff and returns how many were deleted.
+	DeleteStatsBefore(cutoff time.Time) (int, error)
+
+	Close() error
+}
+
+var errFingerprintNotFound = errors.New("fingerprint not found")
+
+// statsBucketInterval is the width of the time buckets that per-fingerprint
+// statistics are aggregated into.
+const statsBucketInterval = time.Hour
+
+// fingerprintEvent is a single execution of a fingerprint reported by crdb.
+type fingerprintEvent struct {
+	fingerprintID uint64
+	input         string
+	timestamp     time.Time
+	// latency is how long crdb spent processing the statement. It is not an
+	// execution latency, since crdb does not execute statements.
+	latency time.Duration
+}
+
+// formatFingerprintID renders a fingerprint ID as fixed-width hex. IDs are
+// 64-bit and would lose precision as JSON numbers in the UI.
+func formatFingerprintID(id uint64) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+func parseFingerprintID(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+type Fingerprint struct {
+	FingerprintID string `json:"fingerprint_id"`
+	Input         string `json:"input"`
+	Timestamp     string `json:"timestamp"`
+}
+
+func (e fingerprintEvent) fingerprint() Fingerprint {
+	return Fingerprint{
+		FingerprintID: formatFingerprintID(e.fingerprintID),
+		Input:         e.input,
+		Timestamp:     e.timestamp.Format(time.RFC3339),
+	}
+}
+
+type FingerprintPage struct {
+	Fingerprints []Fingerprint `json:"fingerprints"`
+	// NextCursor is passed back as the cursor parameter to fetch the next
+	// page. It is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// fingerprintCursor is the position of the last fingerprint on a page. Pages
+// are keyed on (timestamp, id) rather than an offset, so fingerprints arriving
+// or being pruned between requests do not shift later pages.
+type fingerprintCursor struct {
+	unixTime int64
+	id       int64
+}
+
+func (c fingerprintCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.unixTime, c.id)))
+}
+
+func parseFingerprintCursor(s string) (fingerprintCursor, error) {
+	var c fingerprintCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	_, err = fmt.Sscanf(string(b), "%d:%d", &c.unixTime, &c.id)
+	return c, err
+}
+
+// fingerprintsQuery selects a page of fingerprints for Store.QueryFingerprints.
+type fingerprintsQuery struct {
+	limit int
+	// after is the cursor of the previous page, or nil for the first page.
+	after     *fingerprintCursor
+	ascending bool
+	// contains, if set, matches fingerprints whose input contains it,
+	// ignoring case.
+	contains string
+	// pattern, if set, matches fingerprints whose input matches it.
+	pattern *regexp.Regexp
+	// start and end bound the timestamps to [start, end). A zero value
+	// leaves that side unbounded.
+	start time.Time
+	end   time.Time
+}
+
+// matches reports whether an event passes the filters of q, ignoring the
+// cursor.
+func (q fingerprintsQuery) matches(event fingerprintEvent) bool {
+	ts := event.timestamp.Unix()
+	switch {
+	case !q.start.IsZero() && ts < q.start.Unix():
+		return false
+	case !q.end.IsZero() && ts >= q.end.Unix():
+		return false
+	case q.contains != "" && !strings.Contains(strings.ToLower(event.input), strings.ToLower(q.contains)):
+		return false
+	case q.pattern != nil && !q.pattern.MatchString(event.input):
+		return false
+	}
+	return true
+}
+
+type IntervalCount struct {
+	Timestamp string `json:"timestamp"`
+	Count     int    `json:"count"`
+}
+
+// intervalCountsQuery selects the fingerprints counted by
+// Store.IntervalCounts.
+type intervalCountsQuery struct {
+	start    time.Time
+	end      time.Time
+	interval time.Duration
+	// fingerprintIDs restricts the counts to the given fingerprints. All
+	// fingerprints are counted if it is empty.
+	fingerprintIDs []uint64
+}
+
+// bucketRange returns the first bucket and the exclusive end of q as Unix
+// seconds, along with the bucket width in seconds.
+func (q intervalCountsQuery) bucketRange() (first, end, step int64) {
+	step = int64(q.interval / time.Second)
+	first = q.start.Unix() / step * step
+	// Timestamps are stored with second precision, so round the end up to
+	// include fingerprints recorded earlier in its final second.
+	end = q.end.Add(time.Second - 1).Unix()
+	return first, end, step
+}
+
+// zeroFilledCounts expands per-bucket counts keyed by Unix second into a
+// contiguous series covering q.
+func zeroFilledCounts(q intervalCountsQuery, countsByBucket map[int64]int) []IntervalCount {
+	first, end, step := q.bucketRange()
+	var counts []IntervalCount
+	for bucket := first; bucket < end; bucket += step {
+		counts = append(counts, IntervalCount{
+			Timestamp: time.Unix(bucket, 0).Format("2006-01-02 15:04:05"),
+			Count:     countsByBucket[bucket],
+		})
+	}
+	return counts
+}
+
+type StatsBucket struct {
+	BucketStart      string `json:"bucket_start"`
+	ExecutionCount   int64  `json:"execution_count"`
+	FirstSeen        string `json:"first_seen"`
+	LastSeen         string `json:"last_seen"`
+	LatencySumNanos  int64  `json:"latency_sum_nanos"`
+	LatencyMinNanos  int64  `json:"latency_min_nanos"`
+	LatencyMaxNanos  int64  `json:"latency_max_nanos"`
+	LatencyMeanNanos int64  `json:"latency_mean_nanos"`
+}
+
+// FingerprintStats is the aggregate of every bucket recorded for a
+// fingerprint, along with the buckets themselves in chronological order.
+type FingerprintStats struct {
+	FingerprintID string        `json:"fingerprint_id"`
+	Input         string        `json:"input"`
+	Total         StatsBucket   `json:"total"`
+	Buckets       []StatsBucket `json:"buckets"`
+}
+
+// newFingerprintStats fills in the mean latency of each bucket and the total
+// across all of them. buckets must be non-empty and in chronological order.
+func newFingerprintStats(fingerprintID uint64, input string, buckets []StatsBucket) FingerprintStats {
+	stats := FingerprintStats{
+		FingerprintID: formatFingerprintID(fingerprintID),
+		Input:         input,
+		Buckets:       buckets,
+	}
+	for i := range buckets {
+		b := &buckets[i]
+		b.LatencyMeanNanos = b.LatencySumNanos / b.ExecutionCount
+
+		if i == 0 {
+			stats.Total = *b
+			continue
+		}
+		stats.Total.ExecutionCount += b.ExecutionCount
+		stats.Total.LastSeen = b.LastSeen
+		stats.Total.LatencySumNanos += b.LatencySumNanos
+		stats.Total.LatencyMinNanos = min(stats.Total.LatencyMinNanos, b.LatencyMinNanos)
+		stats.Total.LatencyMaxNanos = max(stats.Total.LatencyMaxNanos, b.LatencyMaxNanos)
+	}
+	stats.Total.LatencyMeanNanos = stats.Total.LatencySumNanos / stats.Total.ExecutionCount
+	return stats
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// storeKinds lists a constructor for each Store implementation, so that tests
+// can check they behave the same.
+var storeKinds = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store { return newMemStore(100) }},
+	{"sqlite", func(t *testing.T) Store {
+		store, err := openSQLiteStore(filepath.Join(t.TempDir(), "fingerprints.db"))
+		if err != nil {
+			t.Fatalf("failed to open store: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}},
+}
+
+// openSQLiteStore opens the store at path without logging the migrations
+// applied to it.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(out)
+	return newSQLiteStore(path)
+}
+
+// forEachStore runs test as a subtest against each Store implementation.
+func forEachStore(t *testing.T, test func(t *testing.T, open func(t *testing.T) Store)) {
+	for _, kind := range storeKinds {
+		t.Run(kind.name, func(t *testing.T) { test(t, kind.open) })
+	}
+}
+
+func TestStatsOutOfOrder(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		store := open(t)
+		// Replayed and multi-node traffic arrives out of order.
+		for _, minute := range []time.Duration{30, 10, 50, 20} {
+			err := store.StoreFingerprints([]fingerprintEvent{
+				{fingerprintID: 1, input: "SELECT _", timestamp: base.Add(minute * time.Minute), latency: time.Millisecond},
+			})
+			if err != nil {
+				t.Fatalf("failed to store fingerprint: %v", err)
+			}
+		}
+
+		stats, err := store.FingerprintStats(1)
+		if err != nil {
+			t.Fatalf("FingerprintStats failed: %v", err)
+		}
+		if len(stats.Buckets) != 1 {
+			t.Fatalf("got %d buckets, want 1", len(stats.Buckets))
+		}
+		b := stats.Buckets[0]
+		wantFirst := base.Add(10 * time.Minute).Format(time.RFC3339)
+		wantLast := base.Add(50 * time.Minute).Format(time.RFC3339)
+		if b.ExecutionCount != 4 || b.FirstSeen != wantFirst || b.LastSeen != wantLast {
+			t.Errorf("got count %d, first seen %s and last seen %s, want 4, %s and %s",
+				b.ExecutionCount, b.FirstSeen, b.LastSeen, wantFirst, wantLast)
+		}
+	})
+}
+
+func TestRetentionDeletes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		store := open(t)
+		// Five events an hour apart, so each lands in its own stats bucket.
+		var events []fingerprintEvent
+		for i := 0; i < 5; i++ {
+			events = append(events, fingerprintEvent{fingerprintID: 1, input: "SELECT _", timestamp: base.Add(time.Duration(i) * time.Hour)})
+		}
+		if err := store.StoreFingerprints(events); err != nil {
+			t.Fatalf("failed to store fingerprints: %v", err)
+		}
+
+		check := func(what string, got int, err error, want int) {
+			t.Helper()
+			if err != nil || got != want {
+				t.Errorf("%s returned %d, %v, want %d", what, got, err, want)
+			}
+		}
+		n, err := store.DeleteFingerprintsBefore(base.Add(2*time.Hour), 1)
+		check("DeleteFingerprintsBefore with a limit", n, err, 1)
+		n, err = store.DeleteFingerprintsBefore(base.Add(2*time.Hour), 10)
+		check("DeleteFingerprintsBefore", n, err, 1)
+		n, err = store.DeleteOldestFingerprints(2)
+		check("DeleteOldestFingerprints", n, err, 2)
+		n, err = store.CountFingerprints()
+		check("CountFingerprints", n, err, 1)
+
+		page, err := store.QueryFingerprints(fingerprintsQuery{limit: 10})
+		if err != nil || len(page.Fingerprints) != 1 || page.Fingerprints[0].Timestamp != base.Add(4*time.Hour).Format(time.RFC3339) {
+			t.Errorf("QueryFingerprints returned %v, %v, want only the newest event", page.Fingerprints, err)
+		}
+
+		// Stats outlive the events they were computed from, and are only
+		// deleted once their bucket has ended before the cutoff.
+		n, err = store.DeleteStatsBefore(base.Add(2*time.Hour + 30*time.Minute))
+		check("DeleteStatsBefore", n, err, 2)
+		stats, err := store.FingerprintStats(1)
+		if err != nil || len(stats.Buckets) != 3 {
+			t.Errorf("FingerprintStats returned %d buckets, %v, want 3", len(stats.Buckets), err)
+		}
+		n, err = store.DeleteStatsBefore(base.Add(24 * time.Hour))
+		check("DeleteStatsBefore", n, err, 3)
+		if _, err := store.FingerprintStats(1); err != errFingerprintNotFound {
+			t.Errorf("FingerprintStats returned %v after all stats were deleted, want errFingerprintNotFound", err)
+		}
+	})
+}
+
+func TestSQLiteMigratesLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fingerprints.db")
+	db, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The schema from before migrations were recorded.
+	_, err = db.Exec(`CREATE TABLE fingerprints (id INTEGER PRIMARY KEY AUTOINCREMENT, input TEXT, timestamp TEXT);
+		INSERT INTO fingerprints (input, timestamp) VALUES ('SELECT _', '2024-05-01T12:00:00Z')`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the database again checks that applied migrations are not
+	// run twice.
+	for i := 0; i < 2; i++ {
+		store, err := openSQLiteStore(path)
+		if err != nil {
+			t.Fatalf("failed to open store: %v", err)
+		}
+		var version int
+		if err := store.db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil || version != migrations[len(migrations)-1].version {
+			t.Errorf("schema is at version %d, %v, want %d", version, err, migrations[len(migrations)-1].version)
+		}
+		// The backfilled Unix time lets the old row be paged through.
+		page, err := store.QueryFingerprints(fingerprintsQuery{limit: 10, start: base})
+		if err != nil || len(page.Fingerprints) != 1 || page.Fingerprints[0].Timestamp != base.Format(time.RFC3339) {
+			t.Errorf("QueryFingerprints returned %v, %v, want the row from before the migrations", page.Fingerprints, err)
+		}
+		store.Close()
+	}
+}
+
+func TestSQLiteRejectsNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fingerprints.db")
+	store, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	_, err = store.db.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, 'from the future', '')", migrations[len(migrations)-1].version+1)
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store, err := openSQLiteStore(path); err == nil {
+		store.Close()
+		t.Error("opened a database with a newer schema")
+	}
+}
+
+func TestQueryFingerprintsPagesThroughTies(t *testing.T) {
+	forEachStore(t, func(t *testing.T, open func(t *testing.T) Store) {
+		store := open(t)
+		// Events in the same second are told apart by their ID, so none is
+		// skipped or repeated at a page boundary.
+		var events []fingerprintEvent
+		for i := 0; i < 5; i++ {
+			events = append(events, fingerprintEvent{fingerprintID: uint64(i), input: "SELECT _", timestamp: base})
+		}
+		if err := store.StoreFingerprints(events); err != nil {
+			t.Fatalf("failed to store fingerprints: %v", err)
+		}
+
+		for _, ascending := range []bool{true, false} {
+			seen := map[string]bool{}
+			q := fingerprintsQuery{limit: 2, ascending: ascending}
+			for {
+				page, err := store.QueryFingerprints(q)
+				if err != nil {
+					t.Fatalf("QueryFingerprints failed: %v", err)
+				}
+				for _, fp := range page.Fingerprints {
+					if seen[fp.FingerprintID] {
+						t.Errorf("fingerprint %s returned twice", fp.FingerprintID)
+					}
+					seen[fp.FingerprintID] = true
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				cursor, err := parseFingerprintCursor(page.NextCursor)
+				if err != nil {
+					t.Fatalf("invalid cursor %q: %v", page.NextCursor, err)
+				}
+				q.after = &cursor
+			}
+			if len(seen) != len(events) {
+				t.Errorf("ascending = %v: got %d fingerprints, want %d", ascending, len(seen), len(events))
+			}
+		}
+	})
+}
@@ -0,0 +1,234 @@
+// Package tlsconfig builds TLS configurations for the obs gRPC ingestion
+// endpoint and its clients from PEM files, and reloads the files when they
+// change, so certificates can be rotated without restarting either side.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Files names the PEM files a Reloader loads. Cert and Key are the
+// certificate presented to the other side, and must be set together. CA is
+// the bundle the other side's certificate is verified against; if it is
+// empty, servers do not verify clients and clients use the system roots.
+type Files struct {
+	Cert string
+	Key  string
+	CA   string
+}
+
+// Reloader holds the certificate and CA pool loaded from Files and reloads
+// them while Watch runs. Connections made after a reload use the new files;
+// established connections are not affected.
+type Reloader struct {
+	files Files
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	pool   *x509.CertPool
+	stamps []fileStamp
+}
+
+// fileStamp identifies a version of a file, to notice when it changes.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader loads files, failing if any of them cannot be loaded.
+func NewReloader(files Files) (*Reloader, error) {
+	if (files.Cert == "") != (files.Key == "") {
+		return nil, errors.New("a TLS certificate and key must be given together")
+	}
+	r := &Reloader{files: files}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Watch checks the files for changes every interval until ctx is cancelled.
+// If changed files fail to load, the previous ones stay in use until the
+// files change again.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stamps := r.stat()
+		r.mu.RLock()
+		changed := !equalStamps(stamps, r.stamps)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			log.Printf("Failed to reload TLS files, keeping the previous ones: %v", err)
+			r.mu.Lock()
+			r.stamps = stamps
+			r.mu.Unlock()
+			continue
+		}
+		log.Printf("Reloaded TLS files")
+	}
+}
+
+func (r *Reloader) paths() []string {
+	return []string{r.files.Cert, r.files.Key, r.files.CA}
+}
+
+func (r *Reloader) stat() []fileStamp {
+	var stamps []fileStamp
+	for _, path := range r.paths() {
+		var stamp fileStamp
+		if path != "" {
+			if info, err := os.Stat(path); err == nil {
+				stamp = fileStamp{modTime: info.ModTime(), size: info.Size()}
+			}
+		}
+		stamps = append(stamps, stamp)
+	}
+	return stamps
+}
+
+func equalStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Reloader) reload() error {
+	// Stat before reading, so a change made while reading is noticed on
+	// the next check.
+	stamps := r.stat()
+
+	var cert *tls.Certificate
+	if r.files.Cert != "" {
+		c, err := tls.LoadX509KeyPair(r.files.Cert, r.files.Key)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.files.CA != "" {
+		data, err := os.ReadFile(r.files.CA)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", r.files.CA)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.pool, r.stamps = cert, pool, stamps
+	return nil
+}
+
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, r.pool
+}
+
+// ServerConfig returns a server configuration presenting the loaded
+// certificate, which must be set. If requireClientCert is set, clients must
+// present a certificate signed by the CA; otherwise certificates clients
+// choose to present are verified against the CA if one is set.
+func (r *Reloader) ServerConfig(requireClientCert bool) (*tls.Config, error) {
+	if r.files.Cert == "" {
+		return nil, errors.New("a TLS server needs a certificate and key")
+	}
+	clientAuth := tls.NoClientCert
+	switch {
+	case requireClientCert && r.files.CA == "":
+		return nil, errors.New("requiring client certificates needs a CA to verify them")
+	case requireClientCert:
+		clientAuth = tls.RequireAndVerifyClientCert
+	case r.files.CA != "":
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Each handshake gets a configuration built from the files loaded
+		// at the time, so reloads apply to new connections.
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   clientAuth,
+				NextProtos:   []string{"h2"},
+			}, nil
+		},
+	}, nil
+}
+
+// ClientConfig returns a client configuration that verifies the server
+// against the CA, or the system roots if no CA is set, and presents the
+// loaded certificate, if any, to servers that ask for one.
+func (r *Reloader) ClientConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			if cert == nil {
+				// Presenting no certificate lets the server decide
+				// whether that is acceptable.
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+	}
+	if r.files.CA == "" {
+		return config
+	}
+
+	// RootCAs is fixed once a handshake starts, so to verify against the
+	// CA loaded at the time, skip the built-in verification and verify the
+	// chain here instead.
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		_, pool := r.current()
+		opts := x509.VerifyOptions{
+			Roots:         pool,
+			DNSName:       cs.ServerName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+	return config
+}
@@ -0,0 +1,310 @@
+package tlsconfig
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority generated for a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for localhost signed by ca, for use
+// by a server or a client.
+func (ca *testCA) issue(t *testing.T, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFiles writes a certificate and key issued by certCA, and trustedCA's
+// certificate, to dir under the given prefix and returns their paths. A nil
+// certCA leaves Cert and Key empty, and a nil trustedCA leaves CA empty.
+func writeFiles(t *testing.T, dir, prefix string, certCA, trustedCA *testCA, usage x509.ExtKeyUsage) Files {
+	t.Helper()
+	var files Files
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, prefix+"-"+name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	if certCA != nil {
+		certPEM, keyPEM := certCA.issue(t, usage)
+		files.Cert = write("cert.pem", certPEM)
+		files.Key = write("key.pem", keyPEM)
+	}
+	if trustedCA != nil {
+		files.CA = write("ca.pem", trustedCA.pem)
+	}
+	return files
+}
+
+func newReloader(t *testing.T, files Files) *Reloader {
+	t.Helper()
+	r, err := NewReloader(files)
+	if err != nil {
+		t.Fatalf("NewReloader failed: %v", err)
+	}
+	return r
+}
+
+// handshake connects a client using clientConfig to a server using
+// serverConfig over TCP and returns the errors each side saw.
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) (serverErr, clientErr error) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		serverDone <- tls.Server(conn, serverConfig).Handshake()
+	}()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	clientConfig.ServerName = "localhost"
+	client := tls.Client(conn, clientConfig)
+	clientErr = client.Handshake()
+	serverErr = <-serverDone
+	if clientErr == nil && serverErr != nil {
+		// With TLS 1.3 the client finishes its handshake before the
+		// server has checked its certificate, and only sees the
+		// rejection on its next read.
+		_, clientErr = client.Read(make([]byte, 1))
+	}
+	return serverErr, clientErr
+}
+
+func TestHandshake(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "ca")
+	server := newReloader(t, writeFiles(t, dir, "server", ca, nil, x509.ExtKeyUsageServerAuth))
+	client := newReloader(t, writeFiles(t, dir, "client", nil, ca, 0))
+
+	serverConfig, err := server.ServerConfig(false)
+	if err != nil {
+		t.Fatalf("ServerConfig failed: %v", err)
+	}
+	if serverErr, clientErr := handshake(t, serverConfig, client.ClientConfig()); serverErr != nil || clientErr != nil {
+		t.Errorf("handshake failed: server: %v, client: %v", serverErr, clientErr)
+	}
+}
+
+func TestHandshakeUntrustedServer(t *testing.T) {
+	dir := t.TempDir()
+	server := newReloader(t, writeFiles(t, dir, "server", newCA(t, "server-ca"), nil, x509.ExtKeyUsageServerAuth))
+	client := newReloader(t, writeFiles(t, dir, "client", nil, newCA(t, "other-ca"), 0))
+
+	serverConfig, err := server.ServerConfig(false)
+	if err != nil {
+		t.Fatalf("ServerConfig failed: %v", err)
+	}
+	if _, clientErr := handshake(t, serverConfig, client.ClientConfig()); clientErr == nil {
+		t.Error("client accepted a server certificate signed by another CA")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "ca")
+	other := newCA(t, "other-ca")
+	server := newReloader(t, writeFiles(t, dir, "server", ca, ca, x509.ExtKeyUsageServerAuth))
+	serverConfig, err := server.ServerConfig(true)
+	if err != nil {
+		t.Fatalf("ServerConfig failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		certCA  *testCA
+		wantErr bool
+	}{
+		{"client certificate", ca, false},
+		{"no client certificate", nil, true},
+		{"client certificate from another CA", other, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newReloader(t, writeFiles(t, t.TempDir(), "client", tt.certCA, ca, x509.ExtKeyUsageClientAuth))
+			serverErr, clientErr := handshake(t, serverConfig, client.ClientConfig())
+			if tt.wantErr {
+				if serverErr == nil || clientErr == nil {
+					t.Errorf("handshake succeeded: server: %v, client: %v", serverErr, clientErr)
+				}
+				return
+			}
+			if serverErr != nil || clientErr != nil {
+				t.Errorf("handshake failed: server: %v, client: %v", serverErr, clientErr)
+			}
+		})
+	}
+}
+
+func TestServerConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "ca")
+
+	if _, err := newReloader(t, writeFiles(t, dir, "client", nil, ca, 0)).ServerConfig(false); err == nil {
+		t.Error("ServerConfig succeeded without a certificate")
+	}
+	if _, err := newReloader(t, writeFiles(t, dir, "server", ca, nil, x509.ExtKeyUsageServerAuth)).ServerConfig(true); err == nil {
+		t.Error("ServerConfig succeeded requiring client certificates without a CA")
+	}
+	if _, err := NewReloader(Files{Cert: filepath.Join(dir, "server-cert.pem")}); err == nil {
+		t.Error("NewReloader succeeded with a certificate but no key")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	oldCA := newCA(t, "old-ca")
+	files := writeFiles(t, dir, "server", oldCA, oldCA, x509.ExtKeyUsageServerAuth)
+	server := newReloader(t, files)
+	serverConfig, err := server.ServerConfig(false)
+	if err != nil {
+		t.Fatalf("ServerConfig failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		server.Watch(ctx, 10*time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		<-watchDone
+	}()
+
+	// Rotate to a certificate from a new CA. The files are given a later
+	// modification time, so the change is noticed even if the file system
+	// only records whole seconds and the sizes happen to match.
+	newCA := newCA(t, "new-ca")
+	rotated := writeFiles(t, dir, "server", newCA, newCA, x509.ExtKeyUsageServerAuth)
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{rotated.Cert, rotated.Key, rotated.CA} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := newCA.pem
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, pool := server.current()
+		if pool != nil && pool.Equal(certPool(t, want)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Watch did not reload the rotated files")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// New connections use the rotated certificate.
+	client := newReloader(t, writeFiles(t, t.TempDir(), "client", nil, newCA, 0))
+	if serverErr, clientErr := handshake(t, serverConfig, client.ClientConfig()); serverErr != nil || clientErr != nil {
+		t.Errorf("handshake with the rotated certificate failed: server: %v, client: %v", serverErr, clientErr)
+	}
+	cert, _ := server.current()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(leaf.RawIssuer, newCA.cert.RawSubject) {
+		t.Errorf("serving a certificate issued by %s, want %s", leaf.Issuer, newCA.cert.Subject)
+	}
+}
+
+func certPool(t *testing.T, pemData []byte) *x509.CertPool {
+	t.Helper()
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		t.Fatal("failed to parse CA certificate")
+	}
+	return pool
+}
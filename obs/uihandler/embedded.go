@@ -0,0 +1,67 @@
+package uihandler
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/lassenordahl/disaggui/obs/semver"
+)
+
+// offlineBundles holds the bundle zips copied into offline/ at build time by
+// `make embed-bundle`, for air-gapped environments and for when the bucket
+// server is down.
+//
+//go:embed offline
+var offlineBundles embed.FS
+
+// embeddedVersions returns the versions of the bundles embedded in the binary.
+func embeddedVersions() []string {
+	entries, _ := fs.ReadDir(offlineBundles, "offline")
+	var versions []string
+	for _, entry := range entries {
+		if version, ok := strings.CutSuffix(entry.Name(), ".zip"); ok {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+// embeddedVersion returns the newest embedded bundle satisfying c.
+func embeddedVersion(c semver.Constraint) (string, error) {
+	versions := embeddedVersions()
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no bundle is embedded in this binary")
+	}
+
+	version, ok := semver.MaxSatisfying(versions, c)
+	if !ok {
+		return "", fmt.Errorf("no embedded bundle matches %s (embedded: %s)", c, strings.Join(versions, ", "))
+	}
+	return version, nil
+}
+
+// InstallEmbedded installs the newest bundle embedded in the binary that
+// satisfies constraint, switches to it and returns its version.
+func InstallEmbedded(constraint string) (string, error) {
+	c, err := semver.ParseConstraint(constraint)
+	if err != nil {
+		return "", err
+	}
+	version, err := embeddedVersion(c)
+	if err != nil {
+		return "", err
+	}
+
+	err = install(version, func(f *os.File) error {
+		data, err := offlineBundles.ReadFile("offline/" + version + ".zip")
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	})
+	return version, err
+}
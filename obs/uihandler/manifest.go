@@ -0,0 +1,77 @@
+package uihandler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lassenordahl/disaggui/obs/semver"
+)
+
+// ObsVersion is the version of the obs binary serving the UI. Bundles whose
+// compatible obs range excludes it are never installed.
+var ObsVersion string
+
+// Channel is the release channel bundles are installed from.
+var Channel = "stable"
+
+// bundleInfo is the metadata the bucket server publishes for a bundle.
+type bundleInfo struct {
+	Version       string `json:"version"`
+	Size          int64  `json:"size"`
+	SHA256        string `json:"sha256"`
+	UploadedAt    string `json:"uploaded_at"`
+	MinObsVersion string `json:"min_obs_version"`
+	MaxObsVersion string `json:"max_obs_version"`
+	Channel       string `json:"channel"`
+}
+
+// errNoManifest is returned by fetchBundleManifest if the bucket server does
+// not publish a manifest.
+var errNoManifest = errors.New("bucket server has no manifest")
+
+func fetchBundleManifest(ctx context.Context) ([]bundleInfo, error) {
+	resp, err := get(ctx, BucketURL+"/manifest")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNoManifest
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get manifest: %s", resp.Status)
+	}
+
+	var manifest struct {
+		Bundles []bundleInfo `json:"bundles"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	return manifest.Bundles, nil
+}
+
+// compatible reports whether the bundle is on Channel and works with
+// ObsVersion. Bounds that are missing, or that cannot be checked because
+// either version is not valid semver, do not exclude the bundle.
+func (b bundleInfo) compatible() bool {
+	if b.Channel != "" && b.Channel != Channel {
+		return false
+	}
+
+	obs, err := semver.Parse(ObsVersion)
+	if err != nil {
+		return true
+	}
+	if minVersion, err := semver.Parse(b.MinObsVersion); err == nil && obs.LessThan(minVersion) {
+		return false
+	}
+	if maxVersion, err := semver.Parse(b.MaxObsVersion); err == nil && maxVersion.LessThan(obs) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,300 @@
+package uihandler
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// immutableCacheControl is sent with content-hashed assets, whose
+	// contents never change under the same name.
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	// revalidateCacheControl is sent with everything else, so that browsers
+	// check the ETag before reusing a cached copy and pick up new bundles.
+	revalidateCacheControl = "no-cache"
+)
+
+// hashedAssetPattern matches the file names Vite gives build output under
+// assets/, such as index-CV94lbDq.js: an 8 character hash right before the
+// extension. Hyphens are not allowed in the hash, so that ordinary names like
+// apple-touch-icon.png do not match.
+var hashedAssetPattern = regexp.MustCompile(`-[A-Za-z0-9_]{8}\.[A-Za-z0-9]+$`)
+
+// contentTypes lists the types of files found in bundles. They take precedence
+// over the system MIME database, which is missing some of them on minimal
+// hosts.
+var contentTypes = map[string]string{
+	".css":         "text/css; charset=utf-8",
+	".html":        "text/html; charset=utf-8",
+	".ico":         "image/x-icon",
+	".jpeg":        "image/jpeg",
+	".jpg":         "image/jpeg",
+	".js":          "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".mjs":         "text/javascript; charset=utf-8",
+	".otf":         "font/otf",
+	".png":         "image/png",
+	".svg":         "image/svg+xml",
+	".ttf":         "font/ttf",
+	".txt":         "text/plain; charset=utf-8",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+}
+
+func contentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// encodings lists the precompressed variants that are served, in order of
+// preference, along with the suffix of the files holding them.
+var encodings = []struct {
+	name   string
+	suffix string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// nonUIPrefixes are the paths served by obs itself rather than the UI. Unknown
+// paths under them are not client-side routes, so that a mistyped API call
+// gets a 404 instead of index.html.
+var nonUIPrefixes = []string{"/api", "/debug"}
+
+// isNonUIPath reports whether name is under one of nonUIPrefixes.
+func isNonUIPath(name string) bool {
+	for _, prefix := range nonUIPrefixes {
+		if name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveUI serves the current bundle. Paths that do not name a file and have
+// no extension are client-side routes, and are served index.html, except
+// under nonUIPrefixes.
+func serveUI(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	if isNonUIPath(name) {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := os.Stat(filepath.Join(currentLink, "index.html")); err != nil {
+		serveFallback(w, r)
+		return
+	}
+
+	file := filepath.Join(currentLink, filepath.FromSlash(name))
+	if info, err := os.Stat(file); err != nil || info.IsDir() {
+		if name != "/" && path.Ext(name) != "" {
+			http.NotFound(w, r)
+			return
+		}
+		file = filepath.Join(currentLink, "index.html")
+	}
+	serveStatic(w, r, file, false)
+}
+
+// serveAsset serves an asset from the current bundle or, failing that, from
+// another installed bundle. Asset names are content-hashed, so this lets pages
+// loaded just before a new bundle was switched in fetch the assets they
+// reference.
+func serveAsset(w http.ResponseWriter, r *http.Request) {
+	name := filepath.FromSlash(path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/assets/")))
+	dirs := []string{currentLink}
+	if entries, err := os.ReadDir(versionsDir); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				dirs = append(dirs, filepath.Join(versionsDir, entry.Name()))
+			}
+		}
+	}
+
+	for _, dir := range dirs {
+		file := filepath.Join(dir, "assets", name)
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			serveStatic(w, r, file, hashedAssetPattern.MatchString(filepath.Base(file)))
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// serveStatic serves file, using a precompressed variant next to it if the
+// client accepts one. Only content-hashed assets should be served as
+// immutable; everything else is revalidated with an ETag.
+func serveStatic(w http.ResponseWriter, r *http.Request, file string, immutable bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h := w.Header()
+	// Set before any variant is chosen, so ServeContent does not sniff the
+	// type of compressed data.
+	h.Set("Content-Type", contentType(file))
+	h.Add("Vary", "Accept-Encoding")
+
+	if immutable {
+		h.Set("Cache-Control", immutableCacheControl)
+	} else {
+		h.Set("Cache-Control", revalidateCacheControl)
+	}
+
+	f, encoding, err := openVariant(r, file)
+	if err != nil {
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		return
+	}
+	if encoding != "" {
+		h.Set("Content-Encoding", encoding)
+	}
+	if !immutable {
+		etag, err := fileETag(f)
+		if err != nil {
+			http.Error(w, "Failed to read file", http.StatusInternalServerError)
+			return
+		}
+		h.Set("ETag", etag)
+	}
+	http.ServeContent(w, r, file, info.ModTime(), f)
+}
+
+// openVariant opens the preferred precompressed variant of file accepted by
+// the client, or file itself, and returns the variant's content encoding.
+func openVariant(r *http.Request, file string) (*os.File, string, error) {
+	for _, e := range encodings {
+		if !acceptsEncoding(r, e.name) {
+			continue
+		}
+		if f, err := os.Open(file + e.suffix); err == nil {
+			return f, e.name, nil
+		}
+	}
+	f, err := os.Open(file)
+	return f, "", err
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of r allows
+// encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+	}
+	return false
+}
+
+// fileETag returns a strong ETag for the contents of f, leaving f at its
+// start. Since it is computed from the bytes sent, each precompressed variant
+// gets its own ETag, as strong validators require.
+func fileETag(f *os.File) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)[:12]), nil
+}
+
+// compressibleExtensions lists the file types precompress writes gzip
+// variants of. Images other than SVG and fonts are already compressed.
+var compressibleExtensions = map[string]bool{
+	".css":  true,
+	".html": true,
+	".js":   true,
+	".json": true,
+	".map":  true,
+	".mjs":  true,
+	".svg":  true,
+	".txt":  true,
+	".wasm": true,
+}
+
+// minCompressSize is the size below which files are not worth compressing.
+const minCompressSize = 1024
+
+// precompress writes a gzip variant next to each compressible file in dir
+// that does not already have one, so they are not compressed per request.
+// Brotli variants are served when a bundle ships them, but are not created.
+func precompress(dir string) error {
+	return filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !compressibleExtensions[strings.ToLower(filepath.Ext(file))] {
+			return err
+		}
+		if _, err := os.Stat(file + ".gz"); err == nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() < minCompressSize {
+			return err
+		}
+		return gzipFile(file)
+	})
+}
+
+func gzipFile(file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(file + ".gz")
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,105 @@
+package uihandler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useBundleDir points the package at a temporary bundle directory for the
+// duration of the test and returns it.
+func useBundleDir(t *testing.T) string {
+	t.Helper()
+	oldVersions, oldCurrent := versionsDir, currentLink
+	t.Cleanup(func() { versionsDir, currentLink = oldVersions, oldCurrent })
+
+	dir := t.TempDir()
+	SetBundleDir(dir)
+	return dir
+}
+
+// writeBundle writes files, keyed by slash-separated path, to the installed
+// version's directory.
+func writeBundle(t *testing.T, version string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(versionsDir, version, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHashedAssetPattern(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"index-CV94lbDq.js", true},
+		{"index-a1_b2c3d.css", true},
+		{"vendor.chunk-0123abcd.mjs", true},
+		{"apple-touch-icon.png", false},
+		{"site-manifest-large.json", false},
+		{"index-abc-defg.js", false},
+		{"index-short.js", false},
+		{"index-CV94lbDqX.js", false},
+		{"index.js", false},
+	}
+	for _, tt := range tests {
+		if got := hashedAssetPattern.MatchString(tt.name); got != tt.want {
+			t.Errorf("hashedAssetPattern.MatchString(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	useBundleDir(t)
+	writeBundle(t, "v1.0.0", map[string]string{
+		"index.html":                  `<script src="/assets/index-CV94lbDq.js"></script>`,
+		"assets/index-CV94lbDq.js":    "console.log(1)",
+		"assets/apple-touch-icon.png": "png",
+		"logo-abcdefgh.svg":           "<svg/>",
+	})
+	if err := switchTo("v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path      string
+		immutable bool
+	}{
+		{"/assets/index-CV94lbDq.js", true},
+		{"/assets/apple-touch-icon.png", false},
+		// Hashed names outside assets/ are not under the bundle's control.
+		{"/logo-abcdefgh.svg", false},
+		{"/", false},
+		{"/fingerprints", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := httptest.NewRecorder()
+			if strings.HasPrefix(tt.path, "/assets/") {
+				serveAsset(w, r)
+			} else {
+				serveUI(w, r)
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			cacheControl, etag := w.Header().Get("Cache-Control"), w.Header().Get("ETag")
+			if tt.immutable && (cacheControl != immutableCacheControl || etag != "") {
+				t.Errorf("got Cache-Control %q and ETag %q, want it served as immutable", cacheControl, etag)
+			}
+			if !tt.immutable && (cacheControl != revalidateCacheControl || etag == "") {
+				t.Errorf("got Cache-Control %q and ETag %q, want it revalidated", cacheControl, etag)
+			}
+		})
+	}
+}
@@ -2,6 +2,15 @@ package uihandler
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	_ "embed"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,81 +20,450 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lassenordahl/disaggui/obs/semver"
 )
 
-// DownloadBundle downloads the bundle for the specified version from the bucket server
-func DownloadBundle(version string) error {
-	url := fmt.Sprintf("http://localhost:8081/versions/%s", version)
-	resp, err := http.Get(url)
+// BucketURL is the address of the bucket server bundles are downloaded from.
+var BucketURL = "http://localhost:8081"
+
+// requestTimeout bounds each request to the bucket server, including reading
+// the response body, so that a stalled bucket server cannot hold up obs.
+const requestTimeout = time.Minute
+
+// client makes every request to the bucket server.
+var client = &http.Client{Timeout: requestTimeout}
+
+// get sends a GET request to the bucket server. The caller must close the
+// response body.
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return client.Do(req)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download bundle: %s", resp.Status)
+// PublicKey is the ed25519 key bundles must be signed with. DownloadBundle
+// refuses bundles without a valid signature from it, and refuses to download
+// bundles at all if it is not set, unless AllowUnsigned is.
+var PublicKey ed25519.PublicKey
+
+// AllowUnsigned lets DownloadBundle install bundles without a PublicKey to
+// verify them with. They are then only checked against the SHA-256 manifest,
+// which the bucket server computes from the zip it serves, so it catches
+// corruption in transit but not a compromised bucket server.
+var AllowUnsigned bool
+
+// errNoPublicKey is returned by DownloadBundle if bundles cannot be verified
+// and unsigned bundles are not allowed.
+var errNoPublicKey = errors.New("no public key is set to verify bundle signatures with, and unsigned bundles are not allowed")
+
+// invalidBundleError reports that a bundle failed verification or validation,
+// as opposed to a failure to reach the bucket server. Downloading the same
+// bundle again would fail the same way.
+type invalidBundleError struct {
+	err error
+}
+
+func (e invalidBundleError) Error() string { return e.err.Error() }
+
+func (e invalidBundleError) Unwrap() error { return e.err }
+
+func invalidBundle(format string, args ...any) error {
+	return invalidBundleError{fmt.Errorf(format, args...)}
+}
+
+// isInvalidBundle reports whether err means a bundle cannot be installed no
+// matter how often it is downloaded.
+func isInvalidBundle(err error) bool {
+	var invalid invalidBundleError
+	return errors.As(err, &invalid)
+}
+
+// LoadPublicKey reads a PEM-encoded ed25519 public key, such as one written by
+// `openssl pkey -pubout`.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", path)
 	}
+	return publicKey, nil
+}
 
-	// Create directory to store the downloaded bundle
-	dir := "obsbundle"
-	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+var (
+	// versionsDir holds one extracted directory per installed version.
+	versionsDir = "obsbundle/versions"
+	// currentLink is a symlink to the installed version being served. It is
+	// replaced with a rename, so requests always see a complete bundle.
+	currentLink = "obsbundle/current"
+)
+
+// SetBundleDir sets the directory bundles are installed in, which defaults to
+// obsbundle in the working directory. It must be called before Serve.
+func SetBundleDir(dir string) {
+	versionsDir = filepath.Join(dir, "versions")
+	currentLink = filepath.Join(dir, "current")
+}
+
+// KeepVersions is the number of installed versions kept on disk, including
+// the one being served, for obs to roll back to.
+var KeepVersions = 3
+
+// installMu serializes changes to the installed bundles.
+var installMu sync.Mutex
+
+// DownloadBundle downloads the bundle for the specified version from the bucket
+// server and switches to it. The bundle is verified, extracted into a staging
+// directory and validated before it replaces the current one, so a failed
+// install leaves the current bundle in place.
+func DownloadBundle(ctx context.Context, version string) error {
+	return install(version, func(f *os.File) error {
+		return fetchBundle(ctx, version, f)
+	})
+}
+
+// install switches to version, first writing its zip with writeZip and
+// installing it unless it is already installed.
+func install(version string, writeZip func(f *os.File) error) error {
+	if version == "" || version == "." || version == ".." || strings.ContainsAny(version, `/\`) {
+		return invalidBundle("invalid version %q", version)
+	}
+	if err := os.MkdirAll(versionsDir, os.ModePerm); err != nil {
 		return err
 	}
 
-	// If stuff already exists in the obsbundle, remove it.
-	files, err := os.ReadDir(dir)
-	if err != nil {
-		return err
+	// The zip is written before taking installMu, so that a slow download
+	// does not hold up rollbacks or other installs.
+	dir := filepath.Join(versionsDir, version)
+	var zipPath string
+	if validateBundle(dir) != nil {
+		tempFile, err := os.CreateTemp("", "bundle-*.zip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tempFile.Name())
+		err = writeZip(tempFile)
+		if closeErr := tempFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		zipPath = tempFile.Name()
 	}
 
-	for _, file := range files {
-		if err := os.RemoveAll(filepath.Join(dir, file.Name())); err != nil {
+	installMu.Lock()
+	defer installMu.Unlock()
+
+	if err := validateBundle(dir); err == nil {
+		// The version is already installed, for example because obs was
+		// restarted. Mark it as the most recently installed.
+		now := time.Now()
+		if err := os.Chtimes(dir, now, now); err != nil {
 			return err
 		}
+	} else if zipPath == "" {
+		return fmt.Errorf("bundle %s was removed while switching to it", version)
+	} else if err := installBundle(version, dir, zipPath); err != nil {
+		return err
 	}
 
-	// Create a temporary file to store the downloaded zip file
-	tempFile, err := os.Create(filepath.Join(dir, "bundle.zip"))
+	if err := switchTo(version); err != nil {
+		return err
+	}
+	if err := pruneVersions(); err != nil {
+		log.Printf("Failed to remove old bundles: %v", err)
+	}
+	return nil
+}
+
+// installBundle extracts the zip at zipPath into dir. installMu must be held.
+func installBundle(version, dir, zipPath string) error {
+	// Staging directories start with a dot so they are never mistaken for
+	// installed versions.
+	staging, err := os.MkdirTemp(versionsDir, ".staging-"+version+"-")
 	if err != nil {
 		return err
 	}
-	defer tempFile.Close()
+	defer os.RemoveAll(staging)
+
+	if err := unzip(zipPath, staging); err != nil {
+		return invalidBundle("failed to extract bundle %s: %v", version, err)
+	}
+
+	// The zip holds a single `{version}` directory with the bundle in it.
+	root := filepath.Join(staging, version)
+	if err := validateBundle(root); err != nil {
+		return invalidBundle("bundle %s failed validation: %v", version, err)
+	}
+	if err := precompress(root); err != nil {
+		return fmt.Errorf("failed to compress bundle %s: %v", version, err)
+	}
+
+	// Remove what is left of an earlier install that failed validation.
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(root, dir)
+}
+
+// assetReferencePattern matches the assets index.html loads.
+var assetReferencePattern = regexp.MustCompile(`(?:src|href)="/assets/([^"]+)"`)
 
-	_, err = io.Copy(tempFile, resp.Body)
+// validateBundle checks that dir holds a servable bundle: an index.html and
+// every asset it references.
+func validateBundle(dir string) error {
+	index, err := os.ReadFile(filepath.Join(dir, "index.html"))
 	if err != nil {
 		return err
 	}
+	for _, match := range assetReferencePattern.FindAllSubmatch(index, -1) {
+		if _, err := os.Stat(filepath.Join(dir, "assets", string(match[1]))); err != nil {
+			return fmt.Errorf("missing asset %s", match[1])
+		}
+	}
+	return nil
+}
 
-	// Unzip the downloaded file
-	if err := unzip(tempFile.Name(), dir); err != nil {
+// switchTo points currentLink at an installed version. installMu must be
+// held.
+func switchTo(version string) error {
+	tempLink := currentLink + ".tmp"
+	if err := os.RemoveAll(tempLink); err != nil {
+		return err
+	}
+	if err := os.Symlink(filepath.Join("versions", version), tempLink); err != nil {
 		return err
 	}
+	return os.Rename(tempLink, currentLink)
+}
+
+// CurrentVersion returns the installed version being served.
+func CurrentVersion() (string, error) {
+	target, err := os.Readlink(currentLink)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(target), nil
+}
+
+// installedVersions returns the valid installed versions, most recently
+// installed first. installMu must be held.
+func installedVersions() ([]string, error) {
+	entries, err := os.ReadDir(versionsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	type installed struct {
+		version string
+		modTime time.Time
+	}
+	var versions []installed
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if err := validateBundle(filepath.Join(versionsDir, entry.Name())); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, installed{entry.Name(), info.ModTime()})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].modTime.After(versions[j].modTime)
+	})
 
-	// Remove the temporary zip file
-	if err := os.Remove(tempFile.Name()); err != nil {
+	names := make([]string, len(versions))
+	for i, v := range versions {
+		names[i] = v.version
+	}
+	return names, nil
+}
+
+// pruneVersions removes all but the KeepVersions most recently installed
+// versions, never removing the current one. installMu must be held.
+func pruneVersions() error {
+	current, err := CurrentVersion()
+	if err != nil {
 		return err
 	}
 
-	// Move all the files in the `obsbundle/{version}` directory directly
-	// into the `obsbundle` path.
-	files, err = os.ReadDir(filepath.Join(dir, version))
+	entries, err := os.ReadDir(versionsDir)
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{current: true}
+	versions, err := installedVersions()
 	if err != nil {
 		return err
 	}
+	for _, version := range versions {
+		if len(keep) >= KeepVersions {
+			break
+		}
+		keep[version] = true
+	}
 
-	for _, file := range files {
-		src := filepath.Join(dir, version, file.Name())
-		dest := filepath.Join(dir, file.Name())
-		if err := os.Rename(src, dest); err != nil {
+	for _, entry := range entries {
+		// Leave staging directories to the installs that own them.
+		if keep[entry.Name()] || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(versionsDir, entry.Name())); err != nil {
 			return err
 		}
+		log.Printf("Removed old bundle %s", entry.Name())
+	}
+	return nil
+}
+
+// Rollback switches to the most recently installed valid version if the
+// current bundle is missing or fails validation, and returns the version
+// being served.
+func Rollback() (string, error) {
+	installMu.Lock()
+	defer installMu.Unlock()
+
+	if current, err := CurrentVersion(); err == nil {
+		if validateBundle(currentLink) == nil {
+			return current, nil
+		}
+	}
+
+	versions, err := installedVersions()
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no installed bundle to roll back to")
+	}
+	if err := switchTo(versions[0]); err != nil {
+		return "", err
 	}
+	return versions[0], nil
+}
+
+// fetchBundle downloads the bundle for version into f and checks it against
+// the SHA-256 manifest published by the bucket server and against the
+// bundle's signature, which may only be skipped if AllowUnsigned is set.
+func fetchBundle(ctx context.Context, version string, f *os.File) error {
+	if PublicKey == nil && !AllowUnsigned {
+		return invalidBundleError{errNoPublicKey}
+	}
+
+	digest, err := fetchManifest(ctx, version)
+	if err != nil {
+		return err
+	}
+
+	resp, err := get(ctx, fmt.Sprintf("%s/versions/%s", BucketURL, version))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download bundle: %s", resp.Status)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), digest) {
+		return invalidBundle("bundle %s does not match the checksum in its manifest", version)
+	}
+
+	if PublicKey == nil {
+		return nil
+	}
+	signature, err := fetchSignature(ctx, version)
+	if err != nil {
+		return err
+	}
+	bundle, err := os.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(PublicKey, bundle, signature) {
+		return invalidBundle("bundle %s has an invalid signature", version)
+	}
 	return nil
 }
 
+// fetchSignature returns the detached signature of the bundle for version. A
+// missing signature is not treated as an invalid bundle, since bundles are
+// published before their signatures and a poll can land in between.
+func fetchSignature(ctx context.Context, version string) ([]byte, error) {
+	url := fmt.Sprintf("%s/versions/%s/signature", BucketURL, version)
+	resp, err := get(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get signature: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("bundle %s is not signed yet", version)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get signature: GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// fetchManifest returns the SHA-256 digest of the bundle for version. The
+// manifest is in the format written by `sha256sum`.
+func fetchManifest(ctx context.Context, version string) ([]byte, error) {
+	manifest, err := fetch(ctx, fmt.Sprintf("%s/versions/%s/manifest", BucketURL, version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest: %v", err)
+	}
+
+	fields := strings.Fields(string(manifest))
+	if len(fields) != 2 || fields[1] != version+".zip" {
+		return nil, invalidBundle("malformed manifest for bundle %s", version)
+	}
+	digest, err := hex.DecodeString(fields[0])
+	if err != nil || len(digest) != sha256.Size {
+		return nil, invalidBundle("malformed checksum in manifest for bundle %s", version)
+	}
+	return digest, nil
+}
+
+// fetch returns the body of a successful GET request to url.
+func fetch(ctx context.Context, url string) ([]byte, error) {
+	resp, err := get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
 // Unzip extracts a zip archive to a destination directory
 func unzip(src, dest string) error {
 	r, err := zip.OpenReader(src)
@@ -131,88 +509,96 @@ func unzip(src, dest string) error {
 	return nil
 }
 
-// GetLatestVersion fetches the latest patch version for a given major release from the bucket server
-func GetLatestVersion(majorRelease string) (string, error) {
-	resp, err := http.Get("http://localhost:8081/versions")
+// GetLatestVersion fetches the highest version satisfying the semver
+// constraint, such as "~1.0", from the bucket server. Only bundles on Channel
+// that declare they work with ObsVersion are considered.
+func GetLatestVersion(ctx context.Context, constraint string) (string, error) {
+	c, err := semver.ParseConstraint(constraint)
+	if err != nil {
+		return "", err
+	}
+
+	bundles, err := fetchBundleManifest(ctx)
+	if errors.Is(err, errNoManifest) {
+		bundles, err = listVersions(ctx)
+	}
 	if err != nil {
 		return "", err
 	}
+
+	var versions []string
+	for _, b := range bundles {
+		if b.compatible() {
+			versions = append(versions, b.Version)
+		}
+	}
+
+	latest, ok := semver.MaxSatisfying(versions, c)
+	if !ok {
+		return "", fmt.Errorf("no versions found matching %s for obs %s on the %s channel", constraint, ObsVersion, Channel)
+	}
+	return latest, nil
+}
+
+// listVersions lists the versions on bucket servers that predate /manifest,
+// which serve their names one per line.
+func listVersions(ctx context.Context) ([]bundleInfo, error) {
+	resp, err := get(ctx, BucketURL+"/versions")
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to get versions: %s", resp.Status)
+		return nil, fmt.Errorf("failed to get versions: %s", resp.Status)
 	}
 
-	var versions []string
+	var bundles []bundleInfo
 	for {
 		var version string
 		_, err := fmt.Fscanf(resp.Body, "%s\n", &version)
 		if err != nil {
 			break
 		}
-		versions = append(versions, version)
-	}
-
-	// Filter and sort versions
-	var matchingVersions []string
-	re := regexp.MustCompile(`^` + majorRelease + `\.\d+$`)
-	for _, version := range versions {
-		if re.MatchString(version) {
-			matchingVersions = append(matchingVersions, version)
-		}
+		bundles = append(bundles, bundleInfo{Version: version})
 	}
-	sort.Strings(matchingVersions)
+	return bundles, nil
+}
 
-	if len(matchingVersions) == 0 {
-		return "", fmt.Errorf("no matching versions found for major release %s", majorRelease)
-	}
+// fallbackPage is served in place of the UI when no bundle is installed.
+//
+//go:embed fallback.html
+var fallbackPage []byte
 
-	return matchingVersions[len(matchingVersions)-1], nil
+func serveFallback(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// The page must not be cached, so that reloading it shows the UI once a
+	// bundle is installed.
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(fallbackPage)
 }
-// Serve serves the latest bundle for the specified major release version using the provided router
-func Serve(majorRelease string, r *mux.Router) {
-	latestVersion, err := GetLatestVersion(majorRelease)
-	if err != nil {
-		log.Fatalf("Failed to get latest version: %v", err)
-	}
 
-	err = DownloadBundle(latestVersion)
-	if err != nil {
-		log.Fatalf("Failed to download bundle: %v", err)
+// Serve serves the installed bundle using the provided router. It never waits
+// on the bucket server: it serves the bundle installed by an earlier run or,
+// failing that, the newest embedded bundle satisfying the semver constraint,
+// and a fallback page if there is neither. A Watcher installs the latest
+// bundle from the bucket server in the background.
+func Serve(constraint string, r *mux.Router) {
+	if len(embeddedVersions()) == 0 {
+		log.Println("Warning: no UI bundle is embedded in this binary, so obs has no UI to serve while the bucket server is unreachable and no bundle is installed; build obs with `make obs` to embed one")
 	}
 
-	// Serve assets with proper MIME types.
-	assetsHandler := http.StripPrefix("/assets/", http.FileServer(http.Dir("obsbundle/assets")))
-	r.PathPrefix("/assets/").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasSuffix(r.URL.Path, ".css") {
-			w.Header().Set("Content-Type", "text/css")
-		} else if strings.HasSuffix(r.URL.Path, ".js") {
-			w.Header().Set("Content-Type", "application/javascript")
-		}
-		assetsHandler.ServeHTTP(w, r)
-	}))
-
-	r.PathPrefix("/").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := os.Stat("obsbundle")
-		if os.IsNotExist(err) {
-			log.Println("obsbundle directory does not exist, downloading bundle")
-			err := DownloadBundle(latestVersion)
-			if err != nil {
-				log.Fatalf("Failed to download bundle: %v", err)
-			}
-		}
+	if current, err := Rollback(); err == nil {
+		log.Printf("Serving installed UI bundle %s", current)
+	} else if embedded, err := InstallEmbedded(constraint); err == nil {
+		log.Printf("Serving embedded UI bundle %s", embedded)
+	} else {
+		log.Printf("No UI bundle is installed, serving the fallback page until one is downloaded: %v", err)
+	}
 
-		fs := http.StripPrefix("/", http.FileServer(http.Dir("obsbundle")))
-		fs.ServeHTTP(w, r)
-		if w.Header().Get("Content-Type") == "" {
-			log.Println("File not found, re-downloading bundle")
-			err := DownloadBundle(latestVersion)
-			if err != nil {
-				log.Fatalf("Failed to download bundle: %v", err)
-			}
-			fs.ServeHTTP(w, r)
-		}
-	}))
+	r.PathPrefix("/assets/").HandlerFunc(serveAsset)
+	r.PathPrefix("/").HandlerFunc(serveUI)
 
-	log.Println("UI is being served on port :8080")
+	log.Printf("UI is being served from bundles on %s", BucketURL)
 }
@@ -0,0 +1,218 @@
+package uihandler
+
+import (
+	"archive/zip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// useBucket points BucketURL at a test server using handler for the
+// duration of the test.
+func useBucket(t *testing.T, handler http.Handler) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	old := BucketURL
+	t.Cleanup(func() { BucketURL = old })
+	BucketURL = server.URL
+}
+
+func TestFetchSignature(t *testing.T) {
+	useBucket(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/versions/v1.0.0/signature":
+			w.Write([]byte("signature"))
+		case "/versions/v1.0.2/signature":
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	if signature, err := fetchSignature(context.Background(), "v1.0.0"); err != nil || string(signature) != "signature" {
+		t.Errorf("fetchSignature returned %q, %v", signature, err)
+	}
+	// The signature of a bundle being published may not be uploaded yet,
+	// so a missing one must not mark the bundle invalid.
+	for _, version := range []string{"v1.0.1", "v1.0.2"} {
+		if _, err := fetchSignature(context.Background(), version); err == nil || isInvalidBundle(err) {
+			t.Errorf("fetchSignature(%s) returned %v, want a temporary error", version, err)
+		}
+	}
+}
+
+// bundleZip returns a writeZip function for install that writes a zip
+// holding files, keyed by slash-separated path, in a {version} directory.
+func bundleZip(version string, files map[string]string) func(f *os.File) error {
+	return func(f *os.File) error {
+		w := zip.NewWriter(f)
+		for name, contents := range files {
+			fw, err := w.Create(version + "/" + name)
+			if err != nil {
+				return err
+			}
+			if _, err := fw.Write([]byte(contents)); err != nil {
+				return err
+			}
+		}
+		return w.Close()
+	}
+}
+
+// validBundle returns the files of a bundle that passes validation.
+func validBundle() map[string]string {
+	return map[string]string{
+		"index.html":               `<script src="/assets/index-CV94lbDq.js"></script>`,
+		"assets/index-CV94lbDq.js": "console.log(1)",
+	}
+}
+
+// installVersions installs each version in turn, with each one installed
+// a minute after the last so that they are ordered however fine the file
+// system's timestamps are.
+func installVersions(t *testing.T, versions ...string) {
+	t.Helper()
+	start := time.Now().Add(-time.Hour)
+	for i, version := range versions {
+		if err := install(version, bundleZip(version, validBundle())); err != nil {
+			t.Fatalf("failed to install %s: %v", version, err)
+		}
+		modTime := start.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(filepath.Join(versionsDir, version), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkCurrent checks that the current link points at version.
+func checkCurrent(t *testing.T, version string) {
+	t.Helper()
+	target, err := os.Readlink(currentLink)
+	if err != nil || target != filepath.Join("versions", version) {
+		t.Errorf("current links to %q, %v, want versions/%s", target, err, version)
+	}
+}
+
+// checkInstalled checks that versionsDir holds exactly the versions given.
+func checkInstalled(t *testing.T, versions ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(versionsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	sort.Strings(versions)
+	if len(got) != len(versions) {
+		t.Errorf("versions directory holds %v, want %v", got, versions)
+		return
+	}
+	for i := range got {
+		if got[i] != versions[i] {
+			t.Errorf("versions directory holds %v, want %v", got, versions)
+			return
+		}
+	}
+}
+
+func TestInstall(t *testing.T) {
+	useBundleDir(t)
+	installVersions(t, "v1.0.0")
+	checkCurrent(t, "v1.0.0")
+	if _, err := os.Stat(filepath.Join(currentLink, "assets", "index-CV94lbDq.js")); err != nil {
+		t.Errorf("asset was not installed: %v", err)
+	}
+
+	// A bundle that fails validation is not installed and leaves the
+	// current one in place.
+	broken := validBundle()
+	delete(broken, "assets/index-CV94lbDq.js")
+	if err := install("v1.0.1", bundleZip("v1.0.1", broken)); !isInvalidBundle(err) {
+		t.Errorf("install of a bundle with a missing asset returned %v, want an invalid bundle error", err)
+	}
+	// So is a zip without a {version} directory.
+	wrongRoot := bundleZip("v0.9.0", validBundle())
+	if err := install("v1.0.2", wrongRoot); !isInvalidBundle(err) {
+		t.Errorf("install of a bundle under the wrong directory returned %v, want an invalid bundle error", err)
+	}
+	if err := install("../v1.0.3", bundleZip("../v1.0.3", validBundle())); !isInvalidBundle(err) {
+		t.Errorf("install of a version outside the versions directory returned %v, want an invalid bundle error", err)
+	}
+	checkCurrent(t, "v1.0.0")
+	checkInstalled(t, "v1.0.0")
+
+	// Switching back to an installed version does not download it again.
+	installVersions(t, "v1.1.0")
+	err := install("v1.0.0", func(f *os.File) error {
+		t.Error("installed version was downloaded again")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to switch back to v1.0.0: %v", err)
+	}
+	checkCurrent(t, "v1.0.0")
+	checkInstalled(t, "v1.0.0", "v1.1.0")
+}
+
+func TestPruneVersions(t *testing.T) {
+	useBundleDir(t)
+	old := KeepVersions
+	t.Cleanup(func() { KeepVersions = old })
+	KeepVersions = 2
+
+	installVersions(t, "v1.0.0", "v1.1.0", "v1.2.0", "v1.3.0")
+	checkCurrent(t, "v1.3.0")
+	checkInstalled(t, "v1.2.0", "v1.3.0")
+
+	// The current version is kept even when others were installed more
+	// recently, for example after a rollback.
+	if err := switchTo("v1.2.0"); err != nil {
+		t.Fatal(err)
+	}
+	KeepVersions = 1
+	if err := pruneVersions(); err != nil {
+		t.Fatalf("pruneVersions failed: %v", err)
+	}
+	checkCurrent(t, "v1.2.0")
+	checkInstalled(t, "v1.2.0")
+}
+
+func TestRollback(t *testing.T) {
+	useBundleDir(t)
+	if _, err := Rollback(); err == nil {
+		t.Error("Rollback succeeded with nothing installed")
+	}
+
+	installVersions(t, "v1.0.0", "v1.1.0")
+	if version, err := Rollback(); err != nil || version != "v1.1.0" {
+		t.Errorf("Rollback returned %q, %v, want the current version v1.1.0", version, err)
+	}
+	checkCurrent(t, "v1.1.0")
+
+	// Break the current bundle, as a partly deleted directory would.
+	if err := os.Remove(filepath.Join(versionsDir, "v1.1.0", "assets", "index-CV94lbDq.js")); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := Rollback(); err != nil || version != "v1.0.0" {
+		t.Errorf("Rollback returned %q, %v, want v1.0.0", version, err)
+	}
+	checkCurrent(t, "v1.0.0")
+	// The broken version is left for pruning to remove.
+	checkInstalled(t, "v1.0.0", "v1.1.0")
+
+	if err := os.RemoveAll(filepath.Join(versionsDir, "v1.0.0")); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := Rollback(); err == nil {
+		t.Errorf("Rollback returned %q with no valid version installed, want an error", version)
+	}
+}
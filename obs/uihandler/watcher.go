@@ -0,0 +1,194 @@
+package uihandler
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lassenordahl/disaggui/obs/semver"
+)
+
+const (
+	// initialRetryDelay is how long Run waits to retry a check that could
+	// not reach the bucket server when polling is disabled.
+	initialRetryDelay = 10 * time.Second
+	// maxRetryDelay bounds how far Run spaces out checks while the bucket
+	// server cannot be reached, unless the poll interval is longer.
+	maxRetryDelay = 15 * time.Minute
+)
+
+// Watcher polls the bucket server for newer bundles satisfying a semver
+// constraint and switches to them while obs keeps running. Bundles go through
+// the same verification and atomic install as DownloadBundle, so requests
+// being served during a switch see either the old or the new bundle.
+type Watcher struct {
+	constraint string
+	interval   time.Duration
+
+	// checkMu serializes checks from Run and Reload.
+	checkMu sync.Mutex
+	// failedVersion is the last version that failed verification or
+	// validation, and failedErr the reason. Polls do not retry it until a
+	// newer version is published, but Reload does. Versions that could not
+	// be downloaded are retried by the next poll.
+	failedVersion string
+	failedErr     error
+
+	mu     sync.Mutex
+	status WatcherStatus
+}
+
+// WatcherStatus reports the outcome of the last check for a newer bundle.
+type WatcherStatus struct {
+	Constraint     string `json:"constraint"`
+	CurrentVersion string `json:"current_version"`
+	LatestVersion  string `json:"latest_version,omitempty"`
+	LastCheck      string `json:"last_check,omitempty"`
+	LastError      string `json:"last_error,omitempty"`
+}
+
+// NewWatcher returns a Watcher that checks for bundles satisfying constraint
+// once Run is called, and then every interval if it is positive.
+func NewWatcher(constraint string, interval time.Duration) *Watcher {
+	return &Watcher{
+		constraint: constraint,
+		interval:   interval,
+		status:     WatcherStatus{Constraint: constraint},
+	}
+}
+
+// Run checks for a newer bundle right away, so that obs starts serving the
+// latest bundle without waiting for the bucket server, and then every
+// interval until ctx is cancelled. While the bucket server cannot be reached,
+// checks back off. If the interval is not positive, Run returns after the
+// first check that reaches the bucket server.
+func (w *Watcher) Run(ctx context.Context) {
+	failures := 0
+	for {
+		err := w.check(ctx, false)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to update UI bundle: %v", err)
+		}
+
+		delay := w.interval
+		if err != nil && !isInvalidBundle(err) {
+			failures++
+			delay = w.retryDelay(failures)
+		} else {
+			failures = 0
+			if w.interval <= 0 {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryDelay returns how long Run waits after failing to reach the bucket
+// server failures times in a row. The wait starts at the poll interval, or
+// initialRetryDelay if polling is disabled, and doubles with each failure up
+// to maxRetryDelay or the poll interval, whichever is longer.
+func (w *Watcher) retryDelay(failures int) time.Duration {
+	d := w.interval
+	if d <= 0 {
+		d = initialRetryDelay
+	}
+	limit := max(maxRetryDelay, w.interval)
+	for i := 1; i < failures && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// Reload checks for a newer bundle immediately, retrying versions that
+// previously failed to install, and returns the resulting status.
+func (w *Watcher) Reload(ctx context.Context) (WatcherStatus, error) {
+	err := w.check(ctx, true)
+	return w.Status(), err
+}
+
+func (w *Watcher) Status() WatcherStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	status := w.status
+	status.CurrentVersion, _ = CurrentVersion()
+	return status
+}
+
+// check installs the latest version satisfying the constraint if it is newer
+// than the current one.
+func (w *Watcher) check(ctx context.Context, retryFailed bool) error {
+	w.checkMu.Lock()
+	defer w.checkMu.Unlock()
+
+	latest, err := w.update(ctx, retryFailed)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.LastCheck = time.Now().Format(time.RFC3339)
+	w.status.LastError = ""
+	if latest != "" {
+		w.status.LatestVersion = latest
+	}
+	if err != nil {
+		w.status.LastError = err.Error()
+	} else if w.failedErr != nil {
+		w.status.LastError = w.failedErr.Error()
+	}
+	return err
+}
+
+func (w *Watcher) update(ctx context.Context, retryFailed bool) (string, error) {
+	latest, err := GetLatestVersion(ctx, w.constraint)
+	if err != nil {
+		return "", err
+	}
+
+	current, err := CurrentVersion()
+	if err == nil && !isNewer(latest, current) {
+		w.failedVersion, w.failedErr = "", nil
+		return latest, nil
+	}
+	if latest == w.failedVersion && !retryFailed {
+		return latest, nil
+	}
+
+	if err := DownloadBundle(ctx, latest); err != nil {
+		// Only a bundle that is itself at fault is skipped by later polls.
+		if isInvalidBundle(err) {
+			w.failedVersion, w.failedErr = latest, err
+		}
+		return latest, err
+	}
+	w.failedVersion, w.failedErr = "", nil
+	if current == "" {
+		log.Printf("Installed UI bundle %s", latest)
+	} else {
+		log.Printf("Switched UI bundle from %s to %s", current, latest)
+	}
+	return latest, nil
+}
+
+// isNewer reports whether version a is newer than b. A version that does not
+// parse is treated as older than any that does.
+func isNewer(a, b string) bool {
+	av, err := semver.Parse(a)
+	if err != nil {
+		return false
+	}
+	bv, err := semver.Parse(b)
+	if err != nil {
+		return true
+	}
+	return bv.LessThan(av)
+}
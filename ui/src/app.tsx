@@ -90,9 +90,8 @@ const Page = ({
 
 // Data is of the format:
 // {
-//   "fingerprints": [{ input: string, timestamp: string }]
-//   "current_page": int,
-//   "total_pages": int,
+//   "fingerprints": [{ fingerprint_id: string, input: string, timestamp: string }]
+//   "next_cursor": string, // omitted on the last page
 // }
 const fetchFingerprints = async () => {
   const response = await fetch(`${BASE_URL}/fingerprints`);